@@ -5,8 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -24,38 +24,53 @@ var (
 	apiTimeout = kingpin.Flag("authTimeout", "timeout for auth requests").
 			Default("5m").Duration()
 
+	apiRetries = kingpin.Flag("apiRetries",
+		"maximum attempts for idempotent API requests").
+		Default("5").Int()
+	apiBackoff = kingpin.Flag("apiBackoff",
+		"initial backoff between API retries, doubled on every retry, 0 retries right away").
+		Default("1s").Duration()
+	apiRetryBudget = kingpin.Flag("apiRetryBudget",
+		"maximum time to spend retrying a single API request").
+		Default("2m").Duration()
+
 	acronisURL = kingpin.Flag("acronisURL",
 		`url of acronis endpoint given when creating a client`,
 	).Envar("ACRONIS_CLIENT_URL").Default("https://dev-cloud.acronis.com/").URL()
 )
 
-func NewAPI(quit context.Context, id, secret string, timeout time.Duration, url url.URL) (*AcronisAPI, error) {
+func NewAPI(
+	quit context.Context,
+	id, secret string,
+	timeout time.Duration,
+	retry retryPolicy,
+	url url.URL,
+) (*AcronisAPI, error) {
 	api := AcronisAPI{
 		base:    url,
 		timeout: timeout,
+		retry:   retry,
+		auth:    &tokenSource{},
 	}
 
-	err := api.Auth(timeoutNoCancel(quit, api.timeout), id, secret)
+	ctx, cancel := context.WithTimeout(quit, api.timeout)
+	err := api.Auth(ctx, id, secret)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
 
-	if err = api.clientTenant(timeoutNoCancel(quit, api.timeout)); err != nil {
-		return nil, err
-	}
-
 	api.autoRefresh(quit, id, secret)
 	return &api, nil
 }
 
 type AcronisAPI struct { //nolint
 	timeout    time.Duration
+	retry      retryPolicy
 	base       url.URL
-	token      string
-	idToken    string
+	auth       *tokenSource
 	clientID   string
 	rootTenant string
-	expires    int64
 }
 
 func (a *AcronisAPI) Call(
@@ -75,42 +90,63 @@ func (a *AcronisAPI) Call(
 	}
 
 	if _, isSet := headers["Authorization"]; !isSet {
-		headers.Set("Authorization", "Bearer "+a.token)
-	}
-
-	req := &http.Request{
-		Method: method,
-		URL:    reqURL,
-		Body:   nil,
-		Header: headers,
+		headers.Set("Authorization", "Bearer "+a.auth.Token())
 	}
 
+	var body string
 	if bodyParams != nil {
-		req.Body = ioutil.NopCloser(strings.NewReader(bodyParams.Encode()))
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	}
-
-	req = req.WithContext(ctx)
-
-	client := http.DefaultClient
-	if doneTime, ok := ctx.Deadline(); ok {
-		client.Timeout = time.Until(doneTime)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("problem running request: %w", err)
+		body = bodyParams.Encode()
+		headers.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 500 {
-		respBody, err := ioutil.ReadAll(resp.Body)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		req := &http.Request{
+			Method: method,
+			URL:    reqURL,
+			Body:   nil,
+			Header: headers.Clone(),
+		}
+		if bodyParams != nil {
+			req.Body = ioutil.NopCloser(strings.NewReader(body))
+		}
+		req = req.WithContext(ctx)
+
+		sent := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		observeAPIRequest(method, reqURL.Path, resp, time.Since(sent))
+		wait, retry := a.retry.backoff(method, attempt, time.Since(start), resp, err)
+		if retry {
+			if resp != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if err = sleepCtx(ctx, wait); err != nil {
+				return 0, fmt.Errorf("problem running request: %w", err)
+			}
+			continue
+		}
 		if err != nil {
-			return resp.StatusCode, fmt.Errorf("problem reading error body: %w", err)
+			return 0, fmt.Errorf("problem running request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			respBody, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return resp.StatusCode, fmt.Errorf("problem reading error body: %w", err)
+			}
+			return resp.StatusCode, newAPIError(method+" "+reqURL.Path, resp, respBody)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&returnObj); err != nil {
+			return resp.StatusCode, &DecodeError{
+				StatusCode: resp.StatusCode,
+				Endpoint:   method + " " + reqURL.Path,
+				Err:        err,
+			}
 		}
-		return resp.StatusCode, fmt.Errorf("error: %s", string(respBody))
+		return resp.StatusCode, nil
 	}
-	err = json.NewDecoder(resp.Body).Decode(&returnObj)
-	return resp.StatusCode, err
 }
 
 func basicAuth(username, password string) string {
@@ -118,18 +154,26 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
-// Auth gets or refreshes the Auth token for the Acronis API
+// Auth gets the Auth token for the Acronis API, and the tenant of the client.
 // NOTE YOU HAVE TO CREATE AN ACRONIS API CLIENT under your user.
 // TODO: TOTP not implemented at this time.
 func (a *AcronisAPI) Auth(ctx context.Context, clientID, clientSecret string) error {
+	if err := a.refreshToken(ctx, clientID, clientSecret); err != nil {
+		return err
+	}
+	a.clientID = clientID
+	return a.clientTenant(ctx)
+}
+
+// refreshToken gets a new token and stores it in the tokenSource. It is safe
+// to call while other requests are running.
+func (a *AcronisAPI) refreshToken(ctx context.Context, clientID, clientSecret string) error {
 	var resp struct {
-		Token            string `json:"access_token"`
-		TokenType        string `json:"token_type"`
-		Expires          int64  `json:"expires_on"`
-		ID               string `json:"id_token"`
-		RefreshToken     string `json:"refresh_token"`
-		Error            string `json:"error"`
-		ErrorDescription string `json:"error_description"`
+		Token        string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		Expires      int64  `json:"expires_on"`
+		ID           string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	uri := "./api/2/idp/token"
@@ -141,41 +185,19 @@ func (a *AcronisAPI) Auth(ctx context.Context, clientID, clientSecret string) er
 	header := make(http.Header)
 	header.Set("Authorization", "Basic "+basicAuth(clientID, clientSecret))
 
-	status, err := a.Call(ctx, http.MethodPost, uri, header, nil, query, &resp)
+	_, err := a.Call(ctx, http.MethodPost, uri, header, nil, query, &resp)
+	if _, ok := asAPIError(err); ok {
+		return fmt.Errorf("auth rejected: %w", err)
+	}
 	if err != nil {
 		return fmt.Errorf("problem running request: %w", err)
 	}
-
-	if status < 200 || status >= 300 {
-		return fmt.Errorf("auth rejected: status [%d] [%s] message: %s",
-			status, resp.Error, resp.ErrorDescription)
+	if resp.Expires == 0 {
+		return fmt.Errorf("problem with auth response: no expires_on")
 	}
 
-	a.clientID = clientID
-	a.token = resp.Token
-	a.expires = resp.Expires
-	a.idToken = resp.ID
-
-	return a.clientTenant(ctx)
-}
-
-func (a *AcronisAPI) autoRefresh(done context.Context, id, secret string) {
-	go func() {
-		for {
-			expires := time.Unix(a.expires, 0) // acronis expire time is epoch seconds
-			ticker := time.NewTicker(time.Until(expires) - a.timeout)
-			select {
-			case <-done.Done():
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				err := a.Auth(timeoutNoCancel(done, a.timeout), id, secret)
-				if err != nil {
-					log.Fatalln(err)
-				}
-			}
-		}
-	}()
+	a.auth.set(resp.Token, resp.ID, resp.Expires)
+	return nil
 }
 
 // clientTenant retrieves and sets the tenant UUID of the current authed user.
@@ -190,19 +212,13 @@ func (a *AcronisAPI) clientTenant(ctx context.Context) error {
 			Hostname   string `json:"hostname"`
 		} `json:"data"`
 		Status string `json:"status"`
-		Error  struct {
-			Message string `json:"message"`
-		} `json:"error"`
 	}
 
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/clients/"+a.clientID,
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/clients/"+a.clientID,
 		nil, nil, nil, &respData)
 	if err != nil {
 		return err
 	}
-	if statusCode != http.StatusOK {
-		return fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	}
 	a.rootTenant = respData.TenantID
 	return nil
 }
@@ -213,20 +229,14 @@ func (a *AcronisAPI) clientTenant(ctx context.Context) error {
 // https://dl.acronis.com/u/raml-console/1.0/?raml=https://us5-cloud.acronis.com/api/1/raml/api_ssi.raml&withCredentials=true
 func (a *AcronisAPI) TenantIDToUUID(ctx context.Context, v1ID string) (string, error) {
 	var respData struct {
-		UUID  string `json:"uuid"`
-		Error struct {
-			Message string `json:"message"`
-		} `json:"error"`
+		UUID string `json:"uuid"`
 	}
 
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/1/groups/"+v1ID,
+	_, err := a.Call(ctx, http.MethodGet, "./api/1/groups/"+v1ID,
 		nil, nil, nil, &respData)
 	if err != nil {
 		return "", err
 	}
-	if statusCode != http.StatusOK {
-		return "", fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	}
 	return respData.UUID, nil
 }
 
@@ -243,184 +253,161 @@ type Tenant struct {
 func (a *AcronisAPI) TenantSearch(searchTerm string) ([]Tenant, error) {
 	var respData struct {
 		Tenants []Tenant `json:"items"`
-		Error   struct {
-			Message string `json:"message"`
-		} `json:"error"`
 	}
 	reqQuery := url.Values{}
 	reqQuery.Add("tenant", a.rootTenant)
 	reqQuery.Add("text", searchTerm)
 
-	reqURL := a.base.ResolveReference(&url.URL{Path: "api/2/search"})
-	reqURL.RawQuery = reqQuery.Encode()
-
-	header := http.Header{}
-	header.Set("Authorization", "Bearer "+a.token)
-
-	req := &http.Request{
-		Method: http.MethodGet,
-		URL:    reqURL,
-		Body:   nil,
-		Header: header,
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/search",
+		nil, reqQuery, nil, &respData)
 	if err != nil {
-		return nil, fmt.Errorf("problem running request: %w", err)
+		return []Tenant{}, err
 	}
-	defer resp.Body.Close()
+	return respData.Tenants, nil
+}
 
-	if resp.StatusCode >= 500 {
-		respBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return []Tenant{}, fmt.Errorf("problem reading error body: %w", err)
-		}
-		return []Tenant{}, fmt.Errorf("error: %s", string(respBody))
-	}
-	err = json.NewDecoder(resp.Body).Decode(&respData)
-	if resp.StatusCode != http.StatusOK {
-		return []Tenant{}, fmt.Errorf("error status %d : %s", resp.StatusCode, respData.Error.Message)
-	}
-	return respData.Tenants, err
+// TenantContact is the primary contact of a tenant
+type TenantContact struct {
+	ID         string   `json:"id"`
+	CreatedAt  string   `json:"created_at"`
+	UpdatedAt  string   `json:"updated_at"`
+	Types      []string `json:"types"`
+	Firstname  string   `json:"firstname"`
+	Lastname   string   `json:"lastname"`
+	ExternalID string   `json:"external_id"`
 }
 
-// TODO: unneeded junk below
+// TenantDetails is a v2 tenant as returned by GET /tenants/{uuid}
+type TenantDetails struct {
+	ID              string        `json:"id"`
+	Version         int64         `json:"version"`
+	Name            string        `json:"name"`
+	CustomerType    string        `json:"customer_type"`
+	ParentID        string        `json:"parent_id"`
+	Kind            string        `json:"kind"`
+	Contact         TenantContact `json:"contact"`
+	Contacts        []interface{} `json:"contacts"`
+	Enabled         bool          `json:"enabled"`
+	CustomerID      string        `json:"customer_id"`
+	BrandID         int64         `json:"brand_id"`
+	BrandUUID       string        `json:"brand_uuid"`
+	InternalTag     interface{}   `json:"internal_tag"`
+	OwnerID         string        `json:"owner_id"`
+	HasChildren     bool          `json:"has_children"`
+	AncestralAccess bool          `json:"ancestral_access"`
+	MfaStatus       string        `json:"mfa_status"`
+	PricingMode     string        `json:"pricing_mode"`
+}
 
-func (a *AcronisAPI) TenantInfras(uuid string) ([]string, error) {
-	var respData struct {
-		Infras []string `json:"infras"`
-		Error  struct {
-			Message string `json:"message"`
-		} `json:"error"`
-	}
+// TenantInfo gets the details of a single v2 tenant
+func (a *AcronisAPI) TenantInfo(ctx context.Context, uuid string) (TenantDetails, error) {
+	var respData TenantDetails
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	defer cancel()
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid+"/infra",
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid,
 		nil, nil, nil, &respData)
 	if err != nil {
-		return []string{}, err
+		return TenantDetails{}, err
 	}
-	if statusCode != http.StatusOK {
-		return []string{}, fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	}
-	return respData.Infras, nil
+	return respData, nil
 }
 
-func (a *AcronisAPI) UserDetails(uuid string) (string, error) {
+// TenantChildren lists the uuids of the direct children of a tenant
+func (a *AcronisAPI) TenantChildren(ctx context.Context, uuid string) ([]string, error) {
 	var respData struct {
-		PersonalTenantID string `json:"personal_tenant_id"`
-		Error            struct {
-			Message string `json:"message"`
-		} `json:"error"`
+		Children []string `json:"items"`
 	}
 
-	reqQuery := url.Values{}
-	// reqQuery.Add("parent_id", parent)
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid+"/children",
+		nil, nil, nil, &respData)
+	if err != nil {
+		return []string{}, err
+	}
+	return respData.Children, nil
+}
 
-	reqURL := a.base.ResolveReference(&url.URL{Path: "api/2/users/" + uuid})
-	reqURL.RawQuery = reqQuery.Encode()
+// TenantQuota is the limit set on an offering item, nil values are unlimited
+type TenantQuota struct {
+	Value   *float64 `json:"value"`
+	Overage *float64 `json:"overage"`
+	Version int64    `json:"version"`
+}
 
-	header := http.Header{}
-	header.Set("Authorization", "Bearer "+a.token)
+// TenantUsage is a single usage counter of an offering item
+type TenantUsage struct {
+	Name            string  `json:"name"`
+	UsageName       string  `json:"usage_name"`
+	Type            string  `json:"type"`
+	Edition         string  `json:"edition"`
+	Tenant          string  `json:"tenant"`
+	InfraID         string  `json:"infra_id"`
+	MeasurementUnit string  `json:"measurement_unit"`
+	Value           float64 `json:"value"`
+	AbsoluteValue   float64 `json:"absolute_value"`
+	OfferingItem    struct {
+		Status int          `json:"status"`
+		Quota  *TenantQuota `json:"quota"`
+	} `json:"offering_item"`
+}
 
-	req := &http.Request{
-		Method: http.MethodGet,
-		URL:    reqURL,
-		Body:   nil,
-		Header: header,
+// TenantUsages gets the usage of every offering item of a tenant
+func (a *AcronisAPI) TenantUsages(ctx context.Context, uuid string) ([]TenantUsage, error) {
+	var respData struct {
+		Items []struct {
+			Tenant string        `json:"tenant"`
+			Usages []TenantUsage `json:"usages"`
+		} `json:"items"`
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	defer cancel()
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/usages",
+		nil, url.Values{"tenants": []string{uuid}}, nil, &respData)
 	if err != nil {
-		return "", fmt.Errorf("problem running request: %w", err)
+		return []TenantUsage{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 500 {
-		respBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("problem reading error body: %w", err)
+	var ret []TenantUsage
+	for _, item := range respData.Items {
+		for _, usage := range item.Usages {
+			if usage.Tenant == "" {
+				usage.Tenant = item.Tenant
+			}
+			ret = append(ret, usage)
 		}
-		return "", fmt.Errorf("error: %s", string(respBody))
-	}
-	err = json.NewDecoder(resp.Body).Decode(&respData)
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error status %d : %s", resp.StatusCode, respData.Error.Message)
 	}
-	return respData.PersonalTenantID, err
+	return ret, nil
 }
 
-func (a *AcronisAPI) TenantUsages(uuid string) (interface{}, error) {
-	var respData interface{}
+// TODO: unneeded junk below
+
+func (a *AcronisAPI) TenantInfras(uuid string) ([]string, error) {
+	var respData struct {
+		Infras []string `json:"infras"`
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/usages",
-		nil, url.Values{"tenants": []string{uuid}}, nil, &respData)
-	_ = statusCode
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid+"/infra",
+		nil, nil, nil, &respData)
 	if err != nil {
 		return []string{}, err
 	}
-	// if statusCode != http.StatusOK {
-	// 	return []string{}, fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	// }
-	return respData, nil
+	return respData.Infras, nil
 }
 
-func (a *AcronisAPI) TenantInfo(uuid string) (interface{}, error) {
-	type Contact struct {
-		ID         string   `json:"id"`
-		CreatedAt  string   `json:"created_at"`
-		UpdatedAt  string   `json:"updated_at"`
-		Types      []string `json:"types"`
-		Firstname  string   `json:"firstname"`
-		Lastname   string   `json:"lastname"`
-		ExternalID string   `json:"external_id"`
-	}
+func (a *AcronisAPI) UserDetails(uuid string) (string, error) {
 	var respData struct {
-		ID              string        `json:"id"`
-		Version         int64         `json:"version"`
-		Name            string        `json:"name"`
-		CustomerType    string        `json:"customer_type"`
-		ParentID        string        `json:"parent_id"`
-		Kind            string        `json:"kind"`
-		Contact         Contact       `json:"contact"`
-		Contacts        []interface{} `json:"contacts"`
-		Enabled         bool          `json:"enabled"`
-		CustomerID      string        `json:"customer_id"`
-		BrandID         int64         `json:"brand_id"`
-		BrandUUID       string        `json:"brand_uuid"`
-		InternalTag     interface{}   `json:"internal_tag"`
-		OwnerID         string        `json:"owner_id"`
-		HasChildren     bool          `json:"has_children"`
-		AncestralAccess bool          `json:"ancestral_access"`
-		MfaStatus       string        `json:"mfa_status"`
-		PricingMode     string        `json:"pricing_mode"`
-		Error           struct {
-			Message string `json:"message"`
-		} `json:"error"`
+		PersonalTenantID string `json:"personal_tenant_id"`
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid,
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/users/"+uuid,
 		nil, nil, nil, &respData)
 	if err != nil {
-		return nil, err
-	}
-	if statusCode != http.StatusOK {
-		return nil, fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
+		return "", err
 	}
-	return respData, nil
+	return respData.PersonalTenantID, nil
 }
 
 // Generated by https://quicktype.io
@@ -438,42 +425,14 @@ type Policy struct {
 func (a *AcronisAPI) UserAccessPolicies(uuid string) ([]Policy, error) {
 	var respData struct {
 		Policies []Policy `json:"items"`
-		Error    struct {
-			Message string `json:"message"`
-		} `json:"error"`
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/users/"+uuid+"/access_policies",
+	_, err := a.Call(ctx, http.MethodGet, "./api/2/users/"+uuid+"/access_policies",
 		nil, nil, nil, &respData)
 	if err != nil {
 		return nil, err
 	}
-	_ = statusCode
-	// if statusCode != http.StatusOK {
-	// 	return []string{}, fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	// }
 	return respData.Policies, nil
 }
-
-func (a *AcronisAPI) TenantChildren(uuid string) ([]string, error) {
-	var respData struct {
-		Children []string `json:"items"`
-		Error    struct {
-			Message string `json:"message"`
-		} `json:"error"`
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	defer cancel()
-	statusCode, err := a.Call(ctx, http.MethodGet, "./api/2/tenants/"+uuid+"/children",
-		nil, nil, nil, &respData)
-	if err != nil {
-		return []string{}, err
-	}
-	if statusCode != http.StatusOK {
-		return []string{}, fmt.Errorf("error status %d : %s", statusCode, respData.Error.Message)
-	}
-	return respData.Children, nil
-}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,7 +27,7 @@ func acronisLiveConn(t *testing.T) AcronisAPI {
 		Scheme: "https",
 		Host:   "us5-cloud.acronis.com",
 		Path:   "/",
-	}}
+	}, auth: &tokenSource{}}
 	clientID, clientSecret := os.Getenv("ACRONIS_CLIENT_ID"), os.Getenv("ACRONIS_CLIENT_SECRET")
 	require.NoError(t, api.Auth(context.Background(), clientID, clientSecret))
 	return api
@@ -65,7 +68,7 @@ func acronisMockConn(t *testing.T) AcronisAPI {
 	*apiTimeout = time.Second * 3
 
 	// return a preauthed test api config that will hit this
-	api := AcronisAPI{base: acronisTestURL}
+	api := AcronisAPI{base: acronisTestURL, auth: &tokenSource{}, timeout: *apiTimeout}
 	require.NoError(t, api.Auth(context.Background(), acronisTestUser, acronisTestPass))
 	return api
 }
@@ -82,18 +85,25 @@ func TestAcronisAPI_Auth(t *testing.T) {
 	defer httpmock.DeactivateAndReset()
 
 	_ = acronisMockConn(t)
-	api := AcronisAPI{base: acronisTestURL}
+	api := AcronisAPI{base: acronisTestURL, auth: &tokenSource{}}
 
 	assert.EqualError(t, api.Auth(context.Background(), "baduser", acronisTestPass),
-		"auth rejected: status [400] [invalid_request] message: Authorization header value is not recognized")
-	assert.Equal(t, "", api.token)
+		"auth rejected: POST /api/2/idp/token: status [400] [invalid_request] message: Authorization header value is not recognized")
+	assert.Equal(t, "", api.auth.Token())
 
 	assert.NoError(t, api.Auth(context.Background(), acronisTestUser, acronisTestPass))
-	assert.Equal(t, testAcronisAPI_Auth_testdata["access_token"], api.token)
+	assert.Equal(t, testAcronisAPI_Auth_testdata["access_token"], api.auth.Token())
 
 	assert.EqualError(t, api.Auth(context.Background(), "baduser", acronisTestPass),
-		"auth rejected: status [400] [invalid_request] message: Authorization header value is not recognized")
-	assert.Equal(t, testAcronisAPI_Auth_testdata["access_token"], api.token)
+		"auth rejected: POST /api/2/idp/token: status [400] [invalid_request] message: Authorization header value is not recognized")
+	assert.Equal(t, testAcronisAPI_Auth_testdata["access_token"], api.auth.Token())
+
+	httpmock.RegisterResponder(http.MethodPost,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/2/idp/token"}).String(),
+		httpmock.NewJsonResponderOrPanic(http.StatusOK, map[string]string{"access_token": "noExpiry"}))
+	assert.EqualError(t, api.Auth(context.Background(), acronisTestUser, acronisTestPass),
+		"problem with auth response: no expires_on")
+	assert.Equal(t, testAcronisAPI_Auth_testdata["access_token"], api.auth.Token())
 }
 
 func TestTenantIDToUUID(t *testing.T) {
@@ -111,3 +121,138 @@ func TestTenantIDToUUID(t *testing.T) {
 		})
 	}
 }
+
+func TestAcronisAPI_CallRetry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	api := acronisMockConn(t)
+	api.retry = newRetryPolicy(3, time.Millisecond, time.Second)
+
+	for name, td := range testAcronisAPI_CallRetry_testdata {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			uri := "./api/2/" + name
+			httpmock.RegisterResponder(td.method,
+				acronisTestURL.ResolveReference(&url.URL{Path: uri}).String(),
+				func(req *http.Request) (*http.Response, error) {
+					calls++
+					if calls <= len(td.statuses) {
+						resp := httpmock.NewStringResponse(td.statuses[calls-1], "{}")
+						resp.Header.Set("Retry-After", "0")
+						return resp, nil
+					}
+					return httpmock.NewJsonResponse(http.StatusOK, map[string]string{"ok": "yes"})
+				},
+			)
+
+			var respData map[string]string
+			status, err := api.Call(context.Background(), td.method, uri,
+				nil, nil, nil, &respData)
+			if td.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if td.expStatus == http.StatusOK {
+				assert.Equal(t, "yes", respData["ok"])
+			}
+			assert.Equal(t, td.expStatus, status)
+			assert.Equal(t, td.expCalls, calls)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	wait, ok := retryAfter("7")
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, wait)
+
+	wait, ok = retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	_, ok = retryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestRetryInterval(t *testing.T) {
+	assert.Equal(t, time.Duration(0), newRetryPolicy(3, 0, time.Second).interval(2),
+		"no backoff retries right away")
+	p := newRetryPolicy(3, time.Second, time.Hour)
+	assert.LessOrEqual(t, int64(p.interval(100)), int64(p.max), "an overflowed backoff is capped")
+	assert.GreaterOrEqual(t, int64(p.interval(100)), int64(p.max/2))
+}
+
+func TestTokenSource(t *testing.T) {
+	src := &tokenSource{}
+	assert.False(t, src.Valid())
+
+	src.set("token", "id", time.Now().Add(time.Hour).Unix())
+	assert.True(t, src.Valid())
+	assert.Equal(t, "token", src.Token())
+	assert.InDelta(t, (50 * time.Minute).Seconds(),
+		src.nextRefresh(10*time.Minute).Seconds(), 2)
+
+	src.fail(assert.AnError)
+	assert.True(t, src.Valid(), "a failed refresh keeps the old token")
+	assert.Equal(t, assert.AnError, src.Err())
+	assert.LessOrEqual(t, int64(src.nextRefresh(10*time.Minute)),
+		int64(authRefreshBackoff.base))
+
+	src.set("token", "id", time.Now().Add(time.Minute).Unix())
+	assert.Equal(t, authRefreshMin, src.nextRefresh(10*time.Minute),
+		"a token shorter lived than the margin still waits")
+	src.set("token", "id", 0)
+	assert.Equal(t, authRefreshMin, src.nextRefresh(10*time.Minute))
+
+	src.set("", "", time.Now().Add(-time.Minute).Unix())
+	assert.False(t, src.Valid())
+	assert.NoError(t, src.Err())
+}
+
+func TestAPIError(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	api := acronisMockConn(t)
+
+	for name, td := range testAPIError_testdata {
+		t.Run(name, func(t *testing.T) {
+			uri := "./api/2/broken/" + name
+			httpmock.RegisterResponder(http.MethodGet,
+				acronisTestURL.ResolveReference(&url.URL{Path: uri}).String(),
+				func(req *http.Request) (*http.Response, error) {
+					resp := httpmock.NewStringResponse(td.status, td.body)
+					resp.Header.Set("X-Request-Id", "req-"+name)
+					return resp, nil
+				},
+			)
+
+			_, err := api.Call(context.Background(), http.MethodGet, uri,
+				nil, nil, nil, nil)
+			wrapped := fmt.Errorf("wrapped: %w", err)
+
+			var apiErr *APIError
+			require.True(t, errors.As(wrapped, &apiErr))
+			td.expErr.Endpoint = "GET /api/2/broken/" + name
+			td.expErr.RequestID = "req-" + name
+			assert.Equal(t, td.expErr, *apiErr)
+			assert.Contains(t, err.Error(), td.expErr.Endpoint)
+			assert.Contains(t, err.Error(), td.expErr.RequestID)
+		})
+	}
+
+	uri := "./api/2/broken/body"
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: uri}).String(),
+		httpmock.NewStringResponder(http.StatusOK, "{truncated"))
+	status, err := api.Call(context.Background(), http.MethodGet, uri, nil, nil, nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	var decodeErr *DecodeError
+	require.True(t, errors.As(fmt.Errorf("wrapped: %w", err), &decodeErr))
+	assert.Equal(t, "GET /api/2/broken/body", decodeErr.Endpoint)
+	assert.Equal(t, http.StatusOK, decodeErr.StatusCode)
+	var syntaxErr *json.SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr), "the decode error is kept")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var adminToken = kingpin.Flag("adminToken",
+	"bearer token for the /admin API, the API is disabled when empty").
+	Envar("ADMIN_TOKEN").String()
+
+// walk locks, walks holding the same lock never overlap
+const (
+	lockTasks   = "tasks"   // backfills and polls writing the task views
+	lockRunning = "running" // the running view
+)
+
+// keepWalks is how many finished walks are kept for listing
+const keepWalks = 20
+
+var errWalkRunning = errors.New("another walk holds the lock")
+
+// walkStatus is the state and progress of a walk, as listed by the admin API
+type walkStatus struct {
+	ID       int        `json:"id"`
+	Kind     string     `json:"kind"`
+	Since    string     `json:"since,omitempty"`
+	Tenant   string     `json:"tenant,omitempty"`
+	State    string     `json:"state"` // running, succeeded, failed or cancelled
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Pages    int64      `json:"pages"`
+	Tasks    int64      `json:"tasks"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// walkProgress counts the pages and tasks a walk has fetched so far
+type walkProgress struct {
+	pages, tasks int64
+}
+
+func (p *walkProgress) page(tasks int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.pages, 1)
+	atomic.AddInt64(&p.tasks, int64(tasks))
+}
+
+type progressKey struct{}
+
+// progressFrom finds the progress of the walk running under ctx, nil if
+// there is none
+func progressFrom(ctx context.Context) *walkProgress {
+	p, _ := ctx.Value(progressKey{}).(*walkProgress)
+	return p
+}
+
+type walkRun struct {
+	status    walkStatus
+	lock      string
+	progress  *walkProgress
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// snapshot is the status of the run with its current progress
+func (r *walkRun) snapshot() walkStatus {
+	ret := r.status
+	ret.Pages = atomic.LoadInt64(&r.progress.pages)
+	ret.Tasks = atomic.LoadInt64(&r.progress.tasks)
+	return ret
+}
+
+// walkManager runs walks of the task API one per lock, and keeps track of
+// them so they can be listed and cancelled
+type walkManager struct {
+	ctx    context.Context // cancelled on shutdown
+	mu     sync.Mutex
+	nextID int
+	active map[string]*walkRun // by lock
+	recent []walkStatus        // newest first
+}
+
+func newWalkManager(ctx context.Context) *walkManager {
+	return &walkManager{ctx: ctx, active: map[string]*walkRun{}}
+}
+
+// begin takes the lock for a new walk
+func (m *walkManager) begin(status walkStatus, lock string) (*walkRun, context.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, busy := m.active[lock]; busy {
+		return nil, nil, errWalkRunning
+	}
+	m.nextID++
+	status.ID = m.nextID
+	status.State = "running"
+	status.Started = time.Now()
+	run := &walkRun{status: status, lock: lock, progress: &walkProgress{}}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	run.cancel = cancel
+	m.active[lock] = run
+	return run, context.WithValue(ctx, progressKey{}, run.progress), nil
+}
+
+// finish releases the lock of a walk and records how it went
+func (m *walkManager) finish(run *walkRun, err error) {
+	run.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.active, run.lock)
+
+	status := run.snapshot()
+	finished := time.Now()
+	status.Finished = &finished
+	switch {
+	case err == nil:
+		status.State = "succeeded"
+	case run.cancelled && errors.Is(err, context.Canceled):
+		status.State = "cancelled"
+		status.Error = err.Error()
+	default:
+		status.State = "failed"
+		status.Error = err.Error()
+	}
+	m.recent = append([]walkStatus{status}, m.recent...)
+	if len(m.recent) > keepWalks {
+		m.recent = m.recent[:keepWalks]
+	}
+}
+
+// run runs a walk and waits for it, failing with errWalkRunning if the lock
+// is held
+func (m *walkManager) run(status walkStatus, lock string, fn func(ctx context.Context) error) error {
+	run, ctx, err := m.begin(status, lock)
+	if err != nil {
+		return err
+	}
+	err = trackWalk(status.Kind, func() error { return fn(ctx) })
+	m.finish(run, err)
+	return err
+}
+
+// start runs a walk in the background, returning its status once it holds
+// the lock
+func (m *walkManager) start(status walkStatus, lock string, fn func(ctx context.Context) error) (walkStatus, error) {
+	run, ctx, err := m.begin(status, lock)
+	if err != nil {
+		return walkStatus{}, err
+	}
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		err := trackWalk(status.Kind, func() error { return fn(ctx) })
+		if err != nil {
+			log.Printf("problem with %s walk %d: %v", status.Kind, run.status.ID, err)
+		}
+		m.finish(run, err)
+	}()
+	return run.snapshot(), nil
+}
+
+// cancel stops a running walk, false if no walk with the id is running
+func (m *walkManager) cancel(id int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, run := range m.active {
+		if run.status.ID == id {
+			run.cancelled = true
+			run.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the running walks, then the finished ones, newest first
+func (m *walkManager) list() []walkStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := []walkStatus{}
+	for _, run := range m.active {
+		ret = append(ret, run.snapshot())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID > ret[j].ID })
+	return append(ret, m.recent...)
+}
+
+// filterTenant passes on the tasks of a tenant, matched by its v1 id, name
+// or v2 uuid
+func filterTenant(tree *tenantTree, tenant string, next taskPipelineFunc) taskPipelineFunc {
+	return func(t Task) error {
+		if t.Tenant.ID == tenant || t.Tenant.Name == tenant {
+			return next(t)
+		}
+		if node, ok := tree.LookupTask(t); ok && node.ID == tenant {
+			return next(t)
+		}
+		return nil
+	}
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("problem writing response: %v", err)
+	}
+}
+
+// adminHandler serves the admin API:
+//
+//	POST /admin/backfill?since=48h&tenant=X starts a backfill
+//	GET  /admin/walks lists running and recent walks
+//	POST /admin/cancel?id=N cancels a running walk
+func adminHandler(
+	token string,
+	walks *walkManager,
+	api *AcronisAPI,
+	tree *tenantTree,
+	pipeline walkPipelineFunc,
+) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/backfill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		since := 2 * time.Hour
+		if raw := r.URL.Query().Get("since"); raw != "" {
+			var err error
+			if since, err = time.ParseDuration(raw); err != nil || since <= 0 {
+				http.Error(w, fmt.Sprintf("invalid since: %q", raw), http.StatusBadRequest)
+				return
+			}
+		}
+		tenant := r.URL.Query().Get("tenant")
+		// the API only filters by v1 id, a tenant not mapped to one yet is
+		// walked in full and filtered here
+		var tenantID string
+		if tenant != "" {
+			tenantID, _ = tree.v1ID(tenant)
+		}
+
+		status, err := walks.start(walkStatus{
+			Kind:   "admin",
+			Since:  since.String(),
+			Tenant: tenant,
+		}, lockTasks, func(ctx context.Context) error {
+			next := pipeline(ctx)
+			if tenant != "" {
+				next = filterTenant(tree, tenant, next)
+			}
+			return refreshCache(ctx, api, next, since, tenantID)
+		})
+		if err == errWalkRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("admin backfill %d started for %s\n", status.ID, since.String())
+		writeJSON(w, http.StatusAccepted, status)
+	})
+
+	mux.HandleFunc("/admin/walks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, walks.list())
+	})
+
+	mux.HandleFunc("/admin/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if !walks.cancel(id) {
+			http.Error(w, "no such running walk", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	return requireToken(token, mux)
+}
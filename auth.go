@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authRefreshBackoff bounds the wait between failed token refreshes
+var authRefreshBackoff = newRetryPolicy(0, 5*time.Second, 0)
+
+// authRefreshMin is the least wait between successful token refreshes, so a
+// short lived token never has the identity provider called in a loop
+const authRefreshMin = 30 * time.Second
+
+var (
+	authUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "auth", "up"),
+		"1 if the current API token is valid, 0 if it is missing or expired",
+		nil, nil)
+	authDegradedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "auth", "degraded"),
+		"1 if the last token refresh failed",
+		nil, nil)
+	authExpiresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "auth", "token_expiry_timestamp_seconds"),
+		"Expiry time of the current API token",
+		nil, nil)
+	authLastRefreshDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "auth", "last_refresh_timestamp_seconds"),
+		"Time of the last successful token refresh",
+		nil, nil)
+	authFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "auth", "refresh_failures_total"),
+		"Count of failed token refreshes",
+		nil, nil)
+)
+
+// tokenSource keeps the bearer token and the health of its refreshes behind
+// a lock, so it can be read by API calls while it is being refreshed.
+type tokenSource struct {
+	mu          sync.RWMutex
+	token       string
+	idToken     string
+	expires     int64 // acronis expire time is epoch seconds
+	lastRefresh time.Time
+	lastErr     error
+	failures    int // consecutive failures, reset on success
+	failTotal   int
+}
+
+// Token returns the current bearer token
+func (s *tokenSource) Token() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.token
+}
+
+func (s *tokenSource) set(token, idToken string, expires int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	s.idToken = idToken
+	s.expires = expires
+	s.lastRefresh = time.Now()
+	s.lastErr = nil
+	s.failures = 0
+}
+
+func (s *tokenSource) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	s.failures++
+	s.failTotal++
+}
+
+// Valid reports if there is a token that has not yet expired
+func (s *tokenSource) Valid() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.token != "" && time.Now().Before(time.Unix(s.expires, 0))
+}
+
+// Err returns the error from the last refresh, if it failed
+func (s *tokenSource) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastErr
+}
+
+// nextRefresh is how long to wait before the next refresh. Tokens are
+// refreshed ahead of expiry by margin, but never sooner than authRefreshMin,
+// and failed refreshes back off.
+func (s *tokenSource) nextRefresh(margin time.Duration) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.failures > 0 {
+		return authRefreshBackoff.interval(s.failures)
+	}
+	wait := time.Until(time.Unix(s.expires, 0)) - margin
+	if wait < authRefreshMin {
+		wait = authRefreshMin
+	}
+	return wait
+}
+
+func (s *tokenSource) Describe(ch chan<- *prometheus.Desc) {
+	ch <- authUpDesc
+	ch <- authDegradedDesc
+	ch <- authExpiresDesc
+	ch <- authLastRefreshDesc
+	ch <- authFailuresDesc
+}
+
+func (s *tokenSource) Collect(ch chan<- prometheus.Metric) {
+	up, degraded := 0.0, 0.0
+	if s.Valid() {
+		up = 1
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.lastErr != nil {
+		degraded = 1
+	}
+	var lastRefresh float64
+	if !s.lastRefresh.IsZero() {
+		lastRefresh = float64(s.lastRefresh.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(authUpDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(authDegradedDesc, prometheus.GaugeValue, degraded)
+	ch <- prometheus.MustNewConstMetric(authExpiresDesc, prometheus.GaugeValue, float64(s.expires))
+	ch <- prometheus.MustNewConstMetric(authLastRefreshDesc, prometheus.GaugeValue, lastRefresh)
+	ch <- prometheus.MustNewConstMetric(authFailuresDesc, prometheus.CounterValue, float64(s.failTotal))
+}
+
+// autoRefresh keeps the token fresh until done. Failures are logged and
+// retried with backoff; the old token is kept until it expires, so cached
+// data keeps being served while auth is degraded.
+func (a *AcronisAPI) autoRefresh(done context.Context, id, secret string) {
+	go func() {
+		for {
+			timer := time.NewTimer(a.auth.nextRefresh(a.timeout))
+			select {
+			case <-done.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				ctx, cancel := context.WithTimeout(done, a.timeout)
+				err := a.refreshToken(ctx, id, secret)
+				cancel()
+				if err != nil {
+					a.auth.fail(err)
+					log.Printf("problem refreshing auth token: %v", err)
+				}
+			}
+		}
+	}()
+}
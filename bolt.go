@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	boltTasksBucket   = []byte("tasks")
+	boltIndexBucket   = []byte("index")
+	boltHistoryBucket = []byte("history")
+)
+
+// boltStore keeps a cache view in a bucket of an embedded bolt database.
+//
+// Tasks are stored as JSON under their key in the view's "tasks" bucket.
+// Each secondary index is a bucket under "index" holding value\x00key
+// entries, kept in step with the tasks in the same transaction.
+type boltStore struct {
+	db   *bbolt.DB
+	view []byte
+}
+
+// newBoltStore creates the buckets of a view if they are missing
+func newBoltStore(db *bbolt.DB, view string) (*boltStore, error) {
+	s := &boltStore{db: db, view: []byte(view)}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(s.view)
+		if err != nil {
+			return err
+		}
+		if _, err = root.CreateBucketIfNotExists(boltTasksBucket); err != nil {
+			return err
+		}
+		indexes, err := root.CreateBucketIfNotExists(boltIndexBucket)
+		if err != nil {
+			return err
+		}
+		for name := range taskIndexes {
+			if _, err = indexes.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("problem creating buckets for %s: %w", view, err)
+	}
+	return s, nil
+}
+
+// indexEntry is the key of a task in an index bucket. Keys can't contain
+// control characters, so the last \x00 always splits value from key.
+func indexEntry(value string, key tgtStr) []byte {
+	return []byte(value + "\x00" + string(key))
+}
+
+func (s *boltStore) tasks(tx *bbolt.Tx) *bbolt.Bucket {
+	return tx.Bucket(s.view).Bucket(boltTasksBucket)
+}
+
+func (s *boltStore) index(tx *bbolt.Tx, name string) *bbolt.Bucket {
+	return tx.Bucket(s.view).Bucket(boltIndexBucket).Bucket([]byte(name))
+}
+
+func (s *boltStore) get(tx *bbolt.Tx, key tgtStr) (Task, error) {
+	var t Task
+	raw := s.tasks(tx).Get([]byte(key))
+	if raw == nil {
+		return t, errNotCached
+	}
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return t, fmt.Errorf("problem decoding %s: %w", key, err)
+	}
+	return t, nil
+}
+
+// put replaces a task and moves its index entries
+func (s *boltStore) put(tx *bbolt.Tx, key tgtStr, t Task) error {
+	old, err := s.get(tx, key)
+	if err != nil && err != errNotCached {
+		return err
+	}
+	if err == nil {
+		for name, fn := range taskIndexes {
+			if err = s.index(tx, name).Delete(indexEntry(fn(old), key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	raw, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err = s.tasks(tx).Put([]byte(key), raw); err != nil {
+		return err
+	}
+	for name, fn := range taskIndexes {
+		if err = s.index(tx, name).Put(indexEntry(fn(t), key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Get(key tgtStr) (t Task, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		t, err = s.get(tx, key)
+		return err
+	})
+	return t, err
+}
+
+func (s *boltStore) Put(key tgtStr, t Task) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return s.put(tx, key, t)
+	})
+}
+
+func (s *boltStore) CompareAndSet(key tgtStr, t Task) (stored bool, err error) {
+	if err = key.validate(); err != nil {
+		return false, err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		old, err := s.get(tx, key)
+		if err != nil && err != errNotCached {
+			return err
+		}
+		if err == nil && old.Updated.After(t.Updated) {
+			return nil
+		}
+		stored = true
+		return s.put(tx, key, t)
+	})
+	return stored && err == nil, err
+}
+
+// List reads from a single transaction
+func (s *boltStore) List(index, value string, fn func(tgtStr, Task) error) error {
+	if _, err := indexFunc(index); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bbolt.Tx) error {
+		if index == "" {
+			return s.tasks(tx).ForEach(func(k, v []byte) error {
+				var t Task
+				if err := json.Unmarshal(v, &t); err != nil {
+					return fmt.Errorf("problem decoding %s: %w", k, err)
+				}
+				return fn(tgtStr(k), t)
+			})
+		}
+
+		prefix := []byte(value + "\x00")
+		c := s.index(tx, index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			key := tgtStr(k[bytes.LastIndexByte(k, 0)+1:])
+			t, err := s.get(tx, key)
+			if err != nil {
+				return err
+			}
+			if err = fn(key, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListPrefix seeks to the prefix in the tasks bucket, keys are sorted
+func (s *boltStore) ListPrefix(prefix tgtStr, fn func(tgtStr, Task) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		c := s.tasks(tx).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var t Task
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("problem decoding %s: %w", k, err)
+			}
+			if err := fn(tgtStr(k), t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Delete(key tgtStr) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		old, err := s.get(tx, key)
+		if err == errNotCached {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for name, fn := range taskIndexes {
+			if err = s.index(tx, name).Delete(indexEntry(fn(old), key)); err != nil {
+				return err
+			}
+		}
+		return s.tasks(tx).Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) Count() (count int, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		count = s.tasks(tx).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// boltHistory keeps the runs of each policy as JSON in a single bucket
+type boltHistory struct {
+	db *bbolt.DB
+}
+
+func newBoltHistory(db *bbolt.DB) (*boltHistory, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltHistoryBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("problem creating history bucket: %w", err)
+	}
+	return &boltHistory{db: db}, nil
+}
+
+func (s *boltHistory) get(tx *bbolt.Tx, policyID tgtStr) (policyHistory, error) {
+	var history policyHistory
+	raw := tx.Bucket(boltHistoryBucket).Get([]byte(policyID))
+	if raw == nil {
+		return history, errNotCached
+	}
+	if err := json.Unmarshal(raw, &history); err != nil {
+		return history, fmt.Errorf("problem decoding history %s: %w", policyID, err)
+	}
+	return history, nil
+}
+
+func (s *boltHistory) Get(policyID tgtStr) (history policyHistory, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		history, err = s.get(tx, policyID)
+		return err
+	})
+	return history, err
+}
+
+func (s *boltHistory) Add(policyID tgtStr, run policyRun, max int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		history, err := s.get(tx, policyID)
+		if err != nil && err != errNotCached {
+			return err
+		}
+		history.add(run, max)
+		raw, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltHistoryBucket).Put([]byte(policyID), raw)
+	})
+}
+
+func (s *boltHistory) Delete(policyID tgtStr) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltHistoryBucket).Delete([]byte(policyID))
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	bulkMetrics = kingpin.Flag("bulkMetrics",
+		"serve every cached policy on /policies").
+		Default("false").Bool()
+	bulkMaxPolicies = kingpin.Flag("bulkMaxPolicies",
+		"maximum policies exported on /policies, 0 for no limit").
+		Default("10000").Int()
+	bulkMaxAge = kingpin.Flag("bulkMaxAge",
+		"skip policies on /policies whose last run is older than this, 0 for no limit").
+		Default("0").Duration()
+)
+
+var (
+	bulkStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "policy", "state"),
+		"OK=0 WARNING=1 ERROR=2 UNKNOWN=3 STALE=4",
+		[]string{"policyId", "tenantId", "tenantName"}, nil)
+	bulkInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "policy", "info"),
+		"Metadata Info of policy",
+		[]string{"tenantId", "tenantName", "policyType", "policyId", "policyName", "machineName"}, nil)
+	bulkLastRunDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lastrun", "timestamp"),
+		"Timestamp of last task run",
+		[]string{"policyId", "tenantId", "tenantName"}, nil)
+	bulkExportedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "bulk", "policies_exported"),
+		"Count of policies exported by this scrape",
+		nil, nil)
+	bulkSkippedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "bulk", "policies_skipped"),
+		"Count of cached policies left out of this scrape by limits",
+		[]string{"reason"}, nil)
+)
+
+// policyCollector exports every policy in a cache on each scrape, so one
+// scrape config covers every policy instead of one probe per policy.
+type policyCollector struct {
+	cache       cacheConfig
+	fresh       freshness
+	maxPolicies int           // 0 for no limit
+	maxAge      time.Duration // 0 for no limit
+	scope       *tenantScope  // nil for every tenant
+}
+
+func newPolicyCollector(cache cacheConfig, fresh freshness, maxPolicies int, maxAge time.Duration) *policyCollector {
+	return &policyCollector{
+		cache:       cache,
+		fresh:       fresh,
+		maxPolicies: maxPolicies,
+		maxAge:      maxAge,
+	}
+}
+
+func (c *policyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bulkStateDesc
+	ch <- bulkInfoDesc
+	ch <- bulkLastRunDesc
+	ch <- bulkExportedDesc
+	ch <- bulkSkippedDesc
+}
+
+func (c *policyCollector) Collect(ch chan<- prometheus.Metric) {
+	var exported, tooOld, overLimit int
+	now := time.Now()
+	err := c.cache.walk(func(task Task) error {
+		// policies of other tenants aren't even counted as skipped
+		if !c.scope.allows(task) {
+			return nil
+		}
+		if c.maxAge > 0 && time.Since(task.Updated) > c.maxAge {
+			tooOld++
+			return nil
+		}
+		if c.maxPolicies > 0 && exported >= c.maxPolicies {
+			overLimit++
+			return nil
+		}
+		exported++
+		task = c.fresh.check(task, now)
+
+		ch <- prometheus.MustNewConstMetric(bulkStateDesc, prometheus.GaugeValue,
+			policyStateValue(task), task.Policy.ID, task.Tenant.ID, task.Tenant.Name)
+		ch <- prometheus.MustNewConstMetric(bulkInfoDesc, prometheus.GaugeValue, 1,
+			task.Tenant.ID, task.Tenant.Name, task.Policy.Type,
+			task.Policy.ID, task.Policy.Name, task.Context.MachineName)
+		ch <- prometheus.MustNewConstMetric(bulkLastRunDesc, prometheus.GaugeValue,
+			float64(task.Updated.Unix()), task.Policy.ID, task.Tenant.ID, task.Tenant.Name)
+		return nil
+	})
+	if err != nil {
+		log.Printf("problem walking policy cache: %v", err)
+		ch <- prometheus.NewInvalidMetric(bulkExportedDesc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(bulkExportedDesc, prometheus.GaugeValue, float64(exported))
+	ch <- prometheus.MustNewConstMetric(bulkSkippedDesc, prometheus.GaugeValue, float64(tooOld), "maxAge")
+	ch <- prometheus.MustNewConstMetric(bulkSkippedDesc, prometheus.GaugeValue, float64(overLimit), "maxPolicies")
+}
+
+// bulkHandler serves a policy collector for each scrape, limited to the
+// tenants of the caller
+func bulkHandler(cache cacheConfig, fresh freshness, maxPolicies int, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector := newPolicyCollector(cache, fresh, maxPolicies, maxAge)
+		collector.scope = scopeFrom(r.Context())
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
@@ -1,76 +1,209 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/url"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-func refreshCache(api *AcronisAPI, cache taskPipelineFunc, age time.Duration) error {
+// maxKeyLen keeps an encoded target and its .json suffix within the 255 byte
+// file name limit of most filesystems
+const maxKeyLen = 250
+
+// refreshCache walks the tasks completed within age, only those of a tenant
+// when given its v1 id
+func refreshCache(ctx context.Context, api *AcronisAPI, cache taskPipelineFunc, age time.Duration, tenantID string) error {
 	query := url.Values{}
 	query.Set("order", "asc(updatedAt)")
 	query.Set("updatedAt", "gt("+time.Now().Add(-1*age).Format(time.RFC3339)+")")
 	query.Set("state", "completed")
-	err := api.walkTasks(query, 5000, cache)
+	if tenantID != "" {
+		query.Set("tenantId", tenantID)
+	}
+	err := api.walkTasksConcurrently(ctx, query, 5000, *taskWorkers, cache, nil)
 	return err
 }
 
-func pruneCache(age time.Duration) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if !info.ModTime().Add(age).After(time.Now()) {
-			return nil
+type tgtStr string
+
+// validate checks a target can be used as a cache key
+func (tgt tgtStr) validate() error {
+	switch {
+	case tgt == "":
+		return errors.New("target is empty")
+	case !utf8.ValidString(string(tgt)):
+		return errors.New("target is not valid utf-8")
+	case strings.IndexFunc(string(tgt), unicode.IsControl) >= 0:
+		return errors.New("target contains control characters")
+	case len(tgt.key()) > maxKeyLen:
+		return fmt.Errorf("target is longer than %d bytes once encoded", maxKeyLen)
+	}
+	return nil
+}
+
+// key is the target encoded as a file name. Anything but letters, digits,
+// '-', '_' and a '.' that isn't leading is percent encoded, so a target can't
+// leave the cache directory or collide with another target.
+func (tgt tgtStr) key() string {
+	var b strings.Builder
+	for i := 0; i < len(tgt); i++ {
+		c := tgt[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
 		}
-		return os.Remove(path)
 	}
+	return b.String()
+}
+
+// targetFromKey reverses tgtStr.key
+func targetFromKey(key string) (tgtStr, error) {
+	tgt, err := url.PathUnescape(key)
+	if err != nil {
+		return "", fmt.Errorf("problem decoding cache key %s: %w", key, err)
+	}
+	return tgtStr(tgt), nil
 }
 
-type tgtStr string
 type taskToTargetFunc func(Task) tgtStr
 type targetToCachePathFunc func(tgtStr) string
 type cacheConfig struct {
-	cacheDir     string
+	view         string // name of the view, for metrics and logs
 	taskToTarget taskToTargetFunc
-	targetToPath targetToCachePathFunc
+	store        taskStore
 }
 
-func (cfg cacheConfig) taskPath(task Task) string {
-	return cfg.targetToPath(cfg.taskToTarget(task))
+func (cfg cacheConfig) key(task Task) tgtStr {
+	return cfg.taskToTarget(task)
 }
 
-func ensureCachePath(taskPath targetToCachePathFunc) error {
-	return os.MkdirAll(filepath.Dir(taskPath("junk")), 0755)
+// walk calls fn with every task in the cache
+func (cfg cacheConfig) walk(fn func(Task) error) error {
+	return cfg.store.List("", "", func(_ tgtStr, task Task) error {
+		return fn(task)
+	})
 }
 
 func stdTargetToCachePathFunc(cacheDir string) targetToCachePathFunc {
 	return func(tgt tgtStr) string {
-		return filepath.Join(cacheDir, string(tgt)+".json")
+		return filepath.Join(cacheDir, tgt.key()+".json")
 	}
 }
 
-func stdCachePathFunc(cacheDir string, f taskToTargetFunc) (cacheConfig, error) {
-	ret := cacheConfig{
-		cacheDir:     cacheDir,
-		taskToTarget: f,
-		targetToPath: stdTargetToCachePathFunc(cacheDir),
+func cacheByPolicy(view string, store taskStore) cacheConfig {
+	return cacheConfig{view: view, store: store, taskToTarget: func(task Task) tgtStr { return tgtStr(task.Policy.ID) }}
+}
+func cacheByUuid(view string, store taskStore) cacheConfig {
+	return cacheConfig{view: view, store: store, taskToTarget: func(task Task) tgtStr { return tgtStr(task.UUID) }}
+}
+
+// cacheByTenantName keeps the newest task of each policy in a tenant, a
+// tenant's policies are listed by the tenant index
+func cacheByTenantName(view string, store taskStore) cacheConfig {
+	return cacheConfig{view: view, store: store, taskToTarget: func(task Task) tgtStr {
+		if task.Policy.ID == "" {
+			return ""
+		}
+		return tenantTarget(task) + "/" + tgtStr(task.Policy.ID)
+	}}
+}
+
+// listByTenant lists the newest task of each policy in a tenant, and in
+// every tenant below it with `children=true`
+func listByTenant(cfg cacheConfig, tree *tenantTree) listPoliciesFunc {
+	return func(tenant tgtStr, query url.Values) ([]Task, error) {
+		index, value := "tenant", string(tenant)
+		tenants := map[string]bool{value: true}
+		if query.Get("children") == "true" {
+			for _, child := range tree.Descendants(tree.lookupTarget(value).ID) {
+				tenants[child.Name] = true
+			}
+		}
+		if len(tenants) > 1 {
+			// one pass over the view rather than one per tenant
+			index, value = "", ""
+		}
+
+		// entries cached by tenant alone, before each policy had its own,
+		// are superseded by the policy's entry
+		newest := map[string]Task{}
+		err := cfg.store.List(index, value, func(_ tgtStr, t Task) error {
+			if !tenants[string(tenantTarget(t))] {
+				return nil
+			}
+			if cur, ok := newest[t.Policy.ID]; !ok || t.Updated.After(cur.Updated) {
+				newest[t.Policy.ID] = t
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		var ret []Task
+		for _, t := range newest {
+			ret = append(ret, t)
+		}
+		return ret, nil
 	}
-	return ret, ensureCachePath(ret.targetToPath)
 }
 
-func cacheByPolicy(cacheDir string) (cacheConfig, error) {
-	return stdCachePathFunc(cacheDir, func(task Task) tgtStr { return tgtStr(task.Policy.ID) })
+// cacheByMachine keeps the newest task of each policy on a machine, a
+// machine's policies are listed by the machine index
+func cacheByMachine(view string, store taskStore) cacheConfig {
+	return cacheConfig{view: view, store: store, taskToTarget: machineTarget}
 }
-func cacheByUuid(cacheDir string) (cacheConfig, error) {
-	return stdCachePathFunc(cacheDir, func(task Task) tgtStr { return tgtStr(task.UUID) })
+
+// machineTarget is the machine and policy of a task, empty for tasks without
+// either so they aren't cached
+func machineTarget(task Task) tgtStr {
+	if task.Context.MachineName == "" || task.Policy.ID == "" {
+		return ""
+	}
+	return tgtStr(task.Context.MachineName + "/" + task.Policy.ID)
 }
 
-func cacheByTenantName(cacheDir string) (cacheConfig, error) {
-	return stdCachePathFunc(cacheDir, func(task Task) tgtStr {
-		if task.Tenant.Name != "" {
-			return tgtStr(task.Tenant.Name)
+// cacheByMachineType keeps the newest task of each type on a machine, for
+// tasks without a policy such as manual backups and restores
+func cacheByMachineType(view string, store taskStore) cacheConfig {
+	return cacheConfig{view: view, store: store, taskToTarget: func(task Task) tgtStr {
+		if task.Context.MachineName == "" || task.Type == "" {
+			return ""
 		}
-		return tgtStr(task.Tenant.ID)
-	})
+		return tgtStr(task.Context.MachineName + "/" + task.Type)
+	}}
+}
+
+// listByMachine lists the newest task of each policy on a machine. Keys
+// start with the machine, so only its own entries are read, the name is
+// checked for machines whose name is a prefix of another's.
+func listByMachine(cfg cacheConfig) listPoliciesFunc {
+	return func(machine tgtStr, _ url.Values) ([]Task, error) {
+		var ret []Task
+		err := cfg.store.ListPrefix(machine+"/", func(_ tgtStr, t Task) error {
+			if t.Context.MachineName == string(machine) {
+				ret = append(ret, t)
+			}
+			return nil
+		})
+		return ret, err
+	}
+}
+
+// tenantTarget is the tenant name of a task, or its id if it has no name
+func tenantTarget(task Task) tgtStr {
+	if task.Tenant.Name != "" {
+		return tgtStr(task.Tenant.Name)
+	}
+	return tgtStr(task.Tenant.ID)
 }
 
 // func TenantIDToUUIDGetter(ctx context.Context, v1id string, dest groupcache.Sink) error {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is a non-successful response from the Acronis API.
+// Use errors.As to get at it from wrapped errors.
+type APIError struct {
+	StatusCode int    // HTTP status of the response
+	Code       string // acronis error code, if one was given
+	Message    string // acronis error message, or the raw body
+	Endpoint   string // method and path of the request
+	RequestID  string // X-Request-Id of the response, if one was given
+}
+
+func (e *APIError) Error() string {
+	ret := fmt.Sprintf("%s: status [%d] [%s] message: %s", e.Endpoint, e.StatusCode, e.Code, e.Message)
+	if e.RequestID != "" {
+		ret += " request: " + e.RequestID
+	}
+	return ret
+}
+
+// Unauthorized is true if the token was missing, expired or lacks access
+func (e *APIError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// NotFound is true if the requested object doesn't exist
+func (e *APIError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// Temporary is true if the same request may succeed later
+func (e *APIError) Temporary() bool {
+	return retryableStatus(e.StatusCode)
+}
+
+// DecodeError is a successful response from the Acronis API whose body
+// couldn't be decoded. Use errors.As to get at it from wrapped errors.
+type DecodeError struct {
+	StatusCode int    // HTTP status of the response
+	Endpoint   string // method and path of the request
+	Err        error  // from decoding the body
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: status [%d] problem decoding body: %v", e.Endpoint, e.StatusCode, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// asAPIError returns the APIError wrapped in err, if there is one
+func asAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+// newAPIError builds an APIError from a response and its body. Acronis uses
+// both `{"error": "code", "error_description": "msg"}` and
+// `{"error": {"code": ..., "message": "msg"}}` depending on the endpoint.
+func newAPIError(endpoint string, resp *http.Response, body []byte) *APIError {
+	ret := &APIError{
+		StatusCode: resp.StatusCode,
+		Endpoint:   endpoint,
+		RequestID:  resp.Header.Get("X-Request-Id"),
+	}
+
+	var envelope struct {
+		Error       json.RawMessage `json:"error"`
+		Description string          `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Error) == 0 {
+		ret.Message = strings.TrimSpace(string(body))
+		return ret
+	}
+
+	var code string
+	if err := json.Unmarshal(envelope.Error, &code); err == nil {
+		ret.Code = code
+		ret.Message = envelope.Description
+		return ret
+	}
+
+	var detail struct {
+		Code    interface{} `json:"code"`
+		Message string      `json:"message"`
+	}
+	if err := json.Unmarshal(envelope.Error, &detail); err == nil {
+		if detail.Code != nil {
+			ret.Code = fmt.Sprint(detail.Code)
+		}
+		ret.Message = detail.Message
+	}
+	return ret
+}
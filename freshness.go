@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	maxDataAge = kingpin.Flag("maxDataAge",
+		"report a policy stale once its last task is older than this, 0 disables it").
+		Default("0").Duration()
+	maxDataAgeByType = kingpin.Flag("maxDataAgeByType",
+		"maximum age for a policy type as type=duration, repeatable, overrides --maxDataAge").
+		StringMap()
+)
+
+// freshness decides when a cached task is too old to trust, so a policy
+// that quietly stopped running doesn't keep reporting its last state
+type freshness struct {
+	maxAge time.Duration            // 0 for no limit
+	byType map[string]time.Duration // by policy type, overrides maxAge
+}
+
+func newFreshness(maxAge time.Duration, byType map[string]string) (freshness, error) {
+	ret := freshness{maxAge: maxAge, byType: map[string]time.Duration{}}
+	for policyType, raw := range byType {
+		age, err := time.ParseDuration(raw)
+		if err != nil {
+			return ret, fmt.Errorf("problem with max age of %s: %w", policyType, err)
+		}
+		ret.byType[policyType] = age
+	}
+	return ret, nil
+}
+
+// limit is the maximum age of a task's policy type, 0 for no limit
+func (f freshness) limit(task Task) time.Duration {
+	if age, ok := f.byType[task.Policy.Type]; ok {
+		return age
+	}
+	return f.maxAge
+}
+
+// check marks a task stale if it is past its limit
+func (f freshness) check(task Task, now time.Time) Task {
+	if limit := f.limit(task); limit > 0 && now.Sub(task.Updated) > limit {
+		task.Stale = true
+	}
+	return task
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gcInterval = kingpin.Flag("gcInterval",
+		"interval to remove old entries from the cache, 0 disables it").
+		Default("1h").Duration()
+	gcRetention = kingpin.Flag("gcRetention",
+		"how long an entry is kept after its last task as view=duration, repeatable, 0 keeps a view forever").
+		StringMap()
+	gcMarkStale = kingpin.Flag("gcMarkStale",
+		"mark old entries stale instead of removing them").
+		Bool()
+)
+
+var (
+	gcRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache_gc",
+		Name:      "removed_total",
+		Help:      "Cache entries removed for being past retention",
+	}, []string{"view"})
+	gcMarked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache_gc",
+		Name:      "marked_stale_total",
+		Help:      "Cache entries marked stale for being past retention",
+	}, []string{"view"})
+	gcRetained = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache_gc",
+		Name:      "retained",
+		Help:      "Cache entries within retention at the last collection",
+	}, []string{"view"})
+	gcLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache_gc",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Time of the last completed collection",
+	}, []string{"view"})
+)
+
+// gcDefaultRetention is the retention of views not given one by
+// --gcRetention
+var gcDefaultRetention = map[string]string{
+	"byPolicy":  "2160h",
+	"byTenant":  "2160h",
+	"byMachine": "2160h",
+	"byTask":    "168h",
+	"noPolicy":  "2160h",
+}
+
+// withDefaultRetention lays the given retention over the defaults, so
+// setting one view leaves the others collected
+func withDefaultRetention(given map[string]string) map[string]string {
+	ret := map[string]string{}
+	for name, raw := range gcDefaultRetention {
+		ret[name] = raw
+	}
+	for name, raw := range given {
+		ret[name] = raw
+	}
+	return ret
+}
+
+// gcView is a cache view to collect, and what to keep
+type gcView struct {
+	name      string
+	cfg       cacheConfig
+	retention time.Duration
+	markStale bool
+	// removed is called with the key of each removed entry, to clean up
+	// anything kept alongside it
+	removed func(key tgtStr) error
+}
+
+// gcViews sets the retention of each view it names, views without one or
+// with a retention of 0 are never collected
+func gcViews(retention map[string]string, markStale bool, views map[string]gcView) ([]gcView, error) {
+	var ret []gcView
+	for name, raw := range retention {
+		view, ok := views[name]
+		if !ok {
+			return nil, fmt.Errorf("problem with retention of %s: no such view", name)
+		}
+		keep, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("problem with retention of %s: %w", name, err)
+		}
+		if keep == 0 {
+			continue
+		}
+		view.name, view.retention, view.markStale = name, keep, markStale
+		ret = append(ret, view)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret, nil
+}
+
+// collect removes, or marks stale, every entry whose last task is older
+// than the retention
+func (v gcView) collect(now time.Time) error {
+	cutoff := now.Add(-v.retention)
+	var old []tgtStr
+	var retained int
+	err := v.cfg.store.List("", "", func(key tgtStr, t Task) error {
+		if t.Updated.Before(cutoff) {
+			if !v.markStale || !t.Stale {
+				old = append(old, key)
+			}
+			return nil
+		}
+		retained++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range old {
+		// a newer task may have landed since listing
+		t, err := v.cfg.store.Get(key)
+		if err == errNotCached || (err == nil && !t.Updated.Before(cutoff)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if v.markStale {
+			t.Stale = true
+			marked, err := v.cfg.store.CompareAndSet(key, t)
+			if err != nil {
+				return err
+			}
+			if marked {
+				gcMarked.WithLabelValues(v.name).Inc()
+			}
+			continue
+		}
+
+		if err = v.cfg.store.Delete(key); err != nil {
+			return err
+		}
+		gcRemoved.WithLabelValues(v.name).Inc()
+		if v.removed != nil {
+			if err = v.removed(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	gcRetained.WithLabelValues(v.name).Set(float64(retained))
+	gcLastRun.WithLabelValues(v.name).Set(float64(now.Unix()))
+	return nil
+}
+
+// collectCacheFunc creates a fn to collect each view
+func collectCacheFunc(views []gcView) func() {
+	return func() {
+		for _, view := range views {
+			start := time.Now()
+			if err := view.collect(start); err != nil {
+				log.Printf("problem collecting %s cache: %v", view.name, err)
+				continue
+			}
+			log.Printf("collected %s cache in %s\n", view.name, time.Since(start).String())
+		}
+	}
+}
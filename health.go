@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var staleAfter = kingpin.Flag("staleAfter",
+	"intervals of a refresh without a success before reporting not ready, 0 never does").
+	Default("3").Int()
+
+// componentStatus is the health of one part of the exporter
+type componentStatus struct {
+	OK          bool       `json:"ok"`
+	Detail      string     `json:"detail,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// healthStatus is the body of the health endpoints
+type healthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// ok reports if every component is ok
+func (h healthStatus) ok() bool {
+	for _, c := range h.Components {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// redacted leaves only whether each component is ok, as their details can
+// hold errors of the API
+func (h healthStatus) redacted() healthStatus {
+	ret := healthStatus{Status: h.Status, Components: map[string]componentStatus{}}
+	for name, c := range h.Components {
+		ret.Components[name] = componentStatus{OK: c.OK}
+	}
+	return ret
+}
+
+// readiness decides if the exporter has data worth scraping
+type readiness struct {
+	auth       *tokenSource
+	threshold  int           // failed runs in a row before a job is unready
+	staleAfter int           // intervals without a success before a job is unready
+	backfill   *scheduledJob // the first success of it fills the cache
+	jobs       []*scheduledJob
+}
+
+func (r readiness) check(now time.Time) healthStatus {
+	ret := healthStatus{Components: map[string]componentStatus{}}
+
+	auth := componentStatus{OK: r.auth.Valid()}
+	if err := r.auth.Err(); err != nil {
+		auth.Detail = err.Error()
+	} else if !auth.OK {
+		auth.Detail = "no valid token yet"
+	}
+	ret.Components["auth"] = auth
+
+	if r.backfill != nil {
+		state := r.backfill.state()
+		backfill := componentStatus{OK: !state.lastSuccess.IsZero()}
+		switch {
+		case backfill.OK:
+		case state.lastErr != nil:
+			backfill.Detail = "failing: " + state.lastErr.Error()
+		default:
+			backfill.Detail = "not finished yet"
+		}
+		ret.Components["backfill"] = backfill
+	}
+
+	for _, job := range r.jobs {
+		ret.Components[job.name] = r.checkJob(job, now)
+	}
+
+	ret.Status = "ready"
+	if !ret.ok() {
+		ret.Status = "not ready"
+	}
+	return ret
+}
+
+// checkJob fails a job that keeps failing, or hasn't succeeded in a while
+func (r readiness) checkJob(job *scheduledJob, now time.Time) componentStatus {
+	state := job.state()
+	ret := componentStatus{OK: true}
+	if !state.lastSuccess.IsZero() {
+		last := state.lastSuccess
+		ret.LastSuccess = &last
+	}
+
+	if err := job.failing(r.threshold); err != nil {
+		ret.OK, ret.Detail = false, err.Error()
+		return ret
+	}
+
+	since := state.lastSuccess
+	if since.IsZero() {
+		since = state.started
+	}
+	limit := job.interval * time.Duration(r.staleAfter)
+	if r.staleAfter > 0 && !since.IsZero() && now.Sub(since) > limit {
+		ret.OK = false
+		ret.Detail = fmt.Sprintf("no successful run in %s", now.Sub(since).Round(time.Second))
+	}
+	return ret
+}
+
+// readyHandler reports each component as JSON, failing if any isn't ready.
+// A few failed refreshes still serve from the cache. Anonymous requests only
+// get whether each component is ok.
+func readyHandler(r readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := r.check(time.Now())
+		code := http.StatusOK
+		if !status.ok() {
+			code = http.StatusServiceUnavailable
+		}
+		if anonymous(req.Context()) {
+			status = status.redacted()
+		}
+		writeJSON(w, code, status)
+	})
+}
+
+// healthyHandler reports the process is up and serving, it doesn't depend on
+// the API so a restart never waits on an outage
+func healthyHandler(started time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, healthStatus{
+			Status: "healthy",
+			Components: map[string]componentStatus{
+				"server": {OK: true, Detail: "up " + time.Since(started).Round(time.Second).String()},
+			},
+		})
+	})
+}
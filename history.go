@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+var (
+	historyRuns = kingpin.Flag("historyRuns",
+		"number of runs to keep per policy, 0 disables history").
+		Default("30").Int()
+	successWindows = kingpin.Flag("successWindow",
+		"window to report the success ratio of a policy over, repeatable").
+		Default("24h", "168h", "720h").DurationList()
+)
+
+// policyRun is one completed task of a policy
+type policyRun struct {
+	UUID    string    `json:"uuid"`
+	Started time.Time `json:"startedAt"`
+	Updated time.Time `json:"updatedAt"`
+	Result  string    `json:"result"`
+}
+
+// Success is true for runs that finished, even with warnings
+func (r policyRun) Success() bool {
+	return r.Result == "ok" || r.Result == "warning"
+}
+
+// policyHistory is the newest runs of a policy, newest first
+type policyHistory struct {
+	Runs []policyRun `json:"runs"`
+}
+
+// add inserts a run, replacing an older copy of the same task, and keeps the
+// newest max runs. Runs are added out of order during backfills.
+func (h *policyHistory) add(run policyRun, max int) {
+	for i, seen := range h.Runs {
+		if seen.UUID == run.UUID {
+			if !run.Updated.After(seen.Updated) {
+				return
+			}
+			h.Runs = append(h.Runs[:i], h.Runs[i+1:]...)
+			break
+		}
+	}
+	h.Runs = append(h.Runs, run)
+	sort.SliceStable(h.Runs, func(i, j int) bool {
+		return h.Runs[i].Updated.After(h.Runs[j].Updated)
+	})
+	if len(h.Runs) > max {
+		h.Runs = h.Runs[:max]
+	}
+}
+
+// consecutiveFailures counts failed runs since the last success
+func (h policyHistory) consecutiveFailures() int {
+	for i, run := range h.Runs {
+		if run.Success() {
+			return i
+		}
+	}
+	return len(h.Runs)
+}
+
+// lastSuccess is the newest successful run, false if there are none
+func (h policyHistory) lastSuccess() (policyRun, bool) {
+	for _, run := range h.Runs {
+		if run.Success() {
+			return run, true
+		}
+	}
+	return policyRun{}, false
+}
+
+// successRatio is the share of runs since a time that succeeded, false if
+// there were no runs
+func (h policyHistory) successRatio(since time.Time) (float64, bool) {
+	var runs, ok int
+	for _, run := range h.Runs {
+		if run.Updated.Before(since) {
+			break
+		}
+		runs++
+		if run.Success() {
+			ok++
+		}
+	}
+	if runs == 0 {
+		return 0, false
+	}
+	return float64(ok) / float64(runs), true
+}
+
+// historyStore keeps the recent runs of each policy
+type historyStore interface {
+	// Get returns the runs of a policy, errNotCached if it has none
+	Get(policyID tgtStr) (policyHistory, error)
+	// Add records a run of a policy, keeping its newest max runs
+	Add(policyID tgtStr, run policyRun, max int) error
+	// Delete drops the runs of a policy, if it has any
+	Delete(policyID tgtStr) error
+}
+
+// fsHistory is a directory of locked JSON files, one per policy
+type fsHistory struct {
+	path targetToCachePathFunc
+}
+
+func newFSHistory(dir string) *fsHistory {
+	return &fsHistory{path: stdTargetToCachePathFunc(dir)}
+}
+
+func (s *fsHistory) Get(policyID tgtStr) (policyHistory, error) {
+	var ret policyHistory
+	f, err := lockedfile.OpenFile(s.path(policyID), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return ret, errNotCached
+	}
+	if err != nil {
+		return ret, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&ret)
+	return ret, err
+}
+
+// Add keeps the file locked between reading and writing it
+func (s *fsHistory) Add(policyID tgtStr, run policyRun, max int) error {
+	path := s.path(policyID)
+	f, err := lockedfile.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var history policyHistory
+	if err = json.NewDecoder(f).Decode(&history); err != nil && err != io.EOF {
+		return fmt.Errorf("problem reading history %s: %w", path, err)
+	}
+	history.add(run, max)
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(history)
+}
+
+func (s *fsHistory) Delete(policyID tgtStr) error {
+	err := os.Remove(s.path(policyID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// memoryHistory keeps runs in a map, alongside a memoryStore
+type memoryHistory struct {
+	mu       sync.RWMutex
+	policies map[tgtStr]policyHistory
+}
+
+func newMemoryHistory() *memoryHistory {
+	return &memoryHistory{policies: map[tgtStr]policyHistory{}}
+}
+
+func (s *memoryHistory) Get(policyID tgtStr) (policyHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, ok := s.policies[policyID]
+	if !ok {
+		return policyHistory{}, errNotCached
+	}
+	history.Runs = append([]policyRun{}, history.Runs...)
+	return history, nil
+}
+
+func (s *memoryHistory) Add(policyID tgtStr, run policyRun, max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.policies[policyID]
+	history.add(run, max)
+	s.policies[policyID] = history
+	return nil
+}
+
+func (s *memoryHistory) Delete(policyID tgtStr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, policyID)
+	return nil
+}
+
+// recordHistory adds each task to the run history of its policy
+func recordHistory(history historyStore, max int) taskPipelineFunc {
+	return func(t Task) error {
+		if tgtStr(t.Policy.ID).validate() != nil || max <= 0 {
+			return nil
+		}
+		return history.Add(tgtStr(t.Policy.ID), policyRun{
+			UUID:    t.UUID,
+			Started: t.Started,
+			Updated: t.Updated,
+			Result:  t.Result.Code,
+		}, max)
+	}
+}
+
+// windowLabel formats a window in days when it is whole days, as in 7d
+func windowLabel(window time.Duration) string {
+	if window >= 24*time.Hour && window%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	}
+	return window.String()
+}
+
+// historyProbeExtra reports on the recent runs of the task's policy
+func historyProbeExtra(store historyStore, windows []time.Duration) probeExtraFunc {
+	return func(registry *prometheus.Registry, task Task, _ *tenantScope) error {
+		history, err := store.Get(tgtStr(task.Policy.ID))
+		if err == errNotCached {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		failures := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "policy_consecutive_failures",
+			Help:      "Failed runs of the policy since its last success",
+		})
+		failures.Set(float64(history.consecutiveFailures()))
+
+		ratio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "policy_success_ratio",
+			Help:      "Share of the policy's runs that succeeded, absent if it didn't run",
+		}, []string{"window"})
+		now := time.Now()
+		for _, window := range windows {
+			if value, ok := history.successRatio(now.Add(-window)); ok {
+				ratio.WithLabelValues(windowLabel(window)).Set(value)
+			}
+		}
+
+		collectors := []prometheus.Collector{failures, ratio}
+		if run, ok := history.lastSuccess(); ok {
+			lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "policy_last_success_timestamp",
+				Help:      "Timestamp of the policy's last successful run",
+			})
+			lastSuccess.Set(float64(run.Updated.Unix()))
+			collectors = append(collectors, lastSuccess)
+		}
+
+		for _, c := range collectors {
+			if err = registry.Register(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -34,49 +37,182 @@ func main() {
 	kingpin.Parse()
 	exiting, shutdown := context.WithCancel(context.Background())
 
-	api, err := NewAPI(exiting, *cid, *secret, *apiTimeout, **acronisURL)
+	api, err := NewAPI(exiting, *cid, *secret, *apiTimeout,
+		newRetryPolicy(*apiRetries, *apiBackoff, *apiRetryBudget), **acronisURL)
 	if err != nil {
 		log.Fatal(err)
 	}
+	prometheus.MustRegister(api.auth)
 
-	policyCfg, err := cacheByPolicy(filepath.Join(*cacheDir, "byPolicy"))
+	openStore, history, closeBackend, err := openBackend(*cacheBackend, *cacheDir)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	tenantCfg, err := cacheByTenantName(filepath.Join(*cacheDir, "byTenant"))
+	defer closeBackend()
+
+	policyStore, err := openStore("byPolicy")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policyCfg := cacheByPolicy("byPolicy", policyStore)
+	tenantStore, err := openStore("byTenant")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tenantCfg := cacheByTenantName("byTenant", tenantStore)
+
+	machineStore, err := openStore("byMachine")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	machineCfg := cacheByMachine("byMachine", machineStore)
+
+	uuidStore, err := openStore("byTask")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	taskCfg := cacheByUuid("byTask", uuidStore)
+	noPolicyStore, err := openStore("noPolicy")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	noPolicyCfg := cacheByMachineType("noPolicy", noPolicyStore)
+
+	runningStore, err := openStore("running")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	runningCfg := cacheByPolicy("running", runningStore)
+
+	tenants, err := loadTenantTree(filepath.Join(*cacheDir, "tenants.json"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	prometheus.MustRegister(tenants)
+
+	prometheus.MustRegister(taskDurations)
+	prometheus.MustRegister(selfCollectors(policyCfg, tenantCfg, machineCfg, taskCfg, noPolicyCfg, runningCfg)...)
+
+	cachePipeline := mapLegacyTenants(api, tenants, ingestPipeline(ingestViews{
+		task:        taskCfg,
+		policy:      policyCfg,
+		tenant:      tenantCfg,
+		machine:     machineCfg,
+		noPolicy:    noPolicyCfg,
+		history:     history,
+		historyRuns: *historyRuns,
+	}, observeTaskDuration(taskDurations)))
+
+	// nothing in memory survives a restart, so neither should the watermark
+	statePath := filepath.Join(*cacheDir, "state.json")
+	if *cacheBackend == "memory" {
+		statePath = ""
+	}
+	mark, err := loadWatermark(statePath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fresh, err := newFreshness(*maxDataAge, *maxDataAgeByType)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	cachePipeline := multiTaskPipelineFunc(
-		filterUpdatesOnly(policyCfg, writeTaskPipeline(policyCfg)),
-		filterUpdatesOnly(policyCfg, writeTaskPipeline(tenantCfg)),
-	)
+	// scheduled refreshes retry failures with backoff, serving from the
+	// cache meanwhile, and only turn the exporter unready once sustained
+	walks := newWalkManager(exiting)
+	pollJob := newScheduledJob("poll", time.Hour, *refreshJitter, *refreshRetry,
+		pollCacheFunc(walks, api, cachePipeline, mark))
+	refreshJobs := []*scheduledJob{pollJob}
+	if *runningRefresh > 0 {
+		refreshJobs = append(refreshJobs, newScheduledJob("running", *runningRefresh,
+			*refreshJitter, *refreshRetry, refreshRunningFunc(walks, api, runningCfg)))
+	}
 
 	muxer := http.NewServeMux()
 
-	muxer.Handle("/byPolicy", probeHandler(policyCfg.targetToPath))
-	muxer.Handle("/byTenant", probeHandler(tenantCfg.targetToPath))
-	muxer.Handle("/metrics", promhttp.Handler())
+	muxer.Handle("/byPolicy", probeHandler(policyCfg.store, runningCfg.store, fresh,
+		tenantProbeExtra(tenants), runningProbeExtra(runningCfg, *stuckAfter),
+		historyProbeExtra(history, *successWindows)))
+	muxer.Handle("/byTenant", rollupProbeHandler("tenant", listByTenant(tenantCfg, tenants), fresh,
+		tenantRollupExtra(tenants)))
+	muxer.Handle("/byMachine", rollupProbeHandler("machine", listByMachine(machineCfg), fresh))
+	// single tasks don't go stale, they only ran once
+	muxer.Handle("/byTask", probeHandler(taskCfg.store, nil, freshness{}, tenantProbeExtra(tenants)))
+	muxer.Handle("/noPolicy", probeHandler(noPolicyCfg.store, nil, freshness{}, tenantProbeExtra(tenants)))
+	muxer.Handle("/sd/byPolicy", sdHandler(policyCfg, policyCfg.taskToTarget, sdPolicyLabels))
+	muxer.Handle("/sd/byTenant", sdHandler(tenantCfg, tenantTarget, sdTenantLabels))
+	muxer.Handle("/sd/noPolicy", sdHandler(noPolicyCfg, noPolicyCfg.taskToTarget, sdTaskLabels))
+	muxer.Handle("/usages", usageHandler(api, tenants))
+	if *bulkMetrics {
+		muxer.Handle("/policies", bulkHandler(policyCfg, fresh, *bulkMaxPolicies, *bulkMaxAge))
+	}
+	muxer.Handle("/metrics", unscopedOnly(promhttp.Handler()))
+	muxer.Handle("/-/healthy", healthyHandler(time.Now()))
+	muxer.Handle("/-/ready", readyHandler(readiness{
+		auth:       api.auth,
+		threshold:  *unreadyAfter,
+		staleAfter: *staleAfter,
+		backfill:   pollJob,
+		jobs:       refreshJobs,
+	}))
 	muxer.Handle("/", rootHandler())
 
+	if *adminToken != "" {
+		muxer.Handle("/admin/", adminHandler(*adminToken, walks, api, tenants, cachePipeline))
+	}
+
 	// create a fn to backfill the cache
-	backfill := fillCacheFunc(api, cachePipeline, time.Hour*2, shutdown)
+	backfill := fillCacheFunc(walks, api, cachePipeline, time.Hour*2)
 	signalHandler(exiting, shutdown, backfill) // runs after main() exits
 
 	srv := &http.Server{
 		Addr:    *listen,
 		Handler: muxer,
 	}
+	var web *webServer
+	if *webConfigFile != "" {
+		if web, err = loadWebConfig(*webConfigFile); err != nil {
+			log.Fatalln(err)
+		}
+		// the admin API checks its own token
+		open := []string{"/-/"}
+		if *adminToken != "" {
+			open = append(open, "/admin/")
+		}
+		srv.Handler = web.handler(muxer, tenants, open...)
+	}
 
-	err = startServer(exiting, srv) // runs after main() exits
+	err = startServer(exiting, srv, web) // runs after main() exits
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	fillCacheFunc(api, cachePipeline, time.Hour*48, shutdown)()
-	// set up a regular cache update
-	repeatFn(exiting, time.Hour, fillCacheFunc(api, cachePipeline, time.Hour*2, backfill))
+	if *tenantRefresh > 0 {
+		newScheduledJob("tenants", *tenantRefresh, *refreshJitter, 0,
+			noErr(refreshTenantsFunc(exiting, api, tenants))).start(exiting, true)
+	}
+
+	if *gcInterval > 0 {
+		prometheus.MustRegister(gcRemoved, gcMarked, gcRetained, gcLastRun)
+		views, err := gcViews(withDefaultRetention(*gcRetention), *gcMarkStale, map[string]gcView{
+			"byPolicy":  {cfg: policyCfg, removed: history.Delete},
+			"byTenant":  {cfg: tenantCfg},
+			"byMachine": {cfg: machineCfg},
+			"byTask":    {cfg: taskCfg},
+			"noPolicy":  {cfg: noPolicyCfg},
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		newScheduledJob("gc", *gcInterval, *refreshJitter, 0,
+			noErr(collectCacheFunc(views))).start(exiting, false)
+	}
+
+	// the first poll backfills an empty cache
+	for _, job := range refreshJobs {
+		job.start(exiting, true)
+	}
 	running.Wait() // wait for waitgroup to finish
 }
 
@@ -88,13 +224,17 @@ func rootHandler() http.Handler {
 		<body>
 		<h1>Acronis Exporter</h1>
 		<p><a href="/byPolicy">Probe</a> - requires a uniq_id GET argument. EX: <a href='/byPolicy?target=FC1E08D9-A52D-4CD6-87A1-76E754D994ED'>/byPolicy?target=FC1E08D9-A52D-4CD6-87A1-76E754D994ED</a>< /p>
+		<p><a href="/byMachine">Machine probe</a> - every policy of a machine, requires a hostname target</p>
+		<p><a href="/byTask">Task probe</a> - a single task, requires a task uuid target</p>
+		<p><a href="/noPolicy">Ad-hoc task probe</a> - the last task without a policy, requires a machine/type target</p>
+		<p><a href="/usages">Usages</a> - storage usage and quotas, requires a tenant uuid target</p>
 		</body>
 		</html>`,
 		))
 	})
 }
 
-func signalHandler(quit context.Context, shutdown context.CancelFunc, backfill func()) {
+func signalHandler(quit context.Context, shutdown context.CancelFunc, backfill func() error) {
 	sigReload := make(chan os.Signal, 1)
 	sigQuit := make(chan os.Signal, 1)
 	sigPanic := make(chan os.Signal, 1)
@@ -121,7 +261,9 @@ func signalHandler(quit context.Context, shutdown context.CancelFunc, backfill f
 				return
 			case sig := <-sigReload:
 				log.Println("got " + sig.String() + " backfilling")
-				backfill()
+				if err := backfill(); err != nil {
+					log.Printf("problem backfilling cache: %v", err)
+				}
 			case sig := <-sigPanic:
 				panic("got " + sig.String())
 			}
@@ -129,54 +271,62 @@ func signalHandler(quit context.Context, shutdown context.CancelFunc, backfill f
 	}()
 }
 
+// fillCacheFunc creates a fn that loads the tasks of the last history
 func fillCacheFunc(
+	walks *walkManager,
 	api *AcronisAPI,
-	pipeline taskPipelineFunc,
+	pipeline walkPipelineFunc,
 	history time.Duration,
-	quit context.CancelFunc,
-) func() {
-	return func() {
-		log.Printf("backfilling cache for %s\n", history.String())
-		err := refreshCache(api, pipeline, history)
-		if err != nil {
-			log.Printf("problem refreshing cache: %v", err)
-			quit()
+) func() error {
+	return func() error {
+		if !api.auth.Valid() {
+			return fmt.Errorf("problem backfilling cache, auth degraded: %v", api.auth.Err())
 		}
+		log.Printf("backfilling cache for %s\n", history.String())
+		return walks.run(walkStatus{Kind: "backfill", Since: history.String()}, lockTasks,
+			func(ctx context.Context) error {
+				return refreshCache(ctx, api, pipeline(ctx), history, "")
+			})
 	}
 }
 
-func repeatFn(
-	dying context.Context,
-	interval time.Duration,
-	fn func(),
-) {
-	ticker := time.NewTicker(interval)
-	running.Add(1)
-	go func() {
-		defer running.Done()
-		for {
-			select {
-			case <-dying.Done():
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				fn()
-			}
+// pollCacheFunc creates a fn that loads tasks from where the last one stopped
+func pollCacheFunc(
+	walks *walkManager,
+	api *AcronisAPI,
+	pipeline walkPipelineFunc,
+	mark *watermark,
+) func() error {
+	return func() error {
+		if !api.auth.Valid() {
+			return fmt.Errorf("problem polling cache, auth degraded: %v", api.auth.Err())
 		}
-	}()
+		return walks.run(walkStatus{Kind: "poll"}, lockTasks,
+			func(ctx context.Context) error {
+				return resumeCache(ctx, api, pipeline(ctx), mark)
+			})
+	}
 }
 
-func startServer(quit context.Context, srv *http.Server) error {
+// startServer serves srv, over TLS if the web config has certificates
+func startServer(quit context.Context, srv *http.Server, web *webServer) error {
 	l, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return err
 	}
+	scheme := "http"
+	if web != nil && web.tlsEnabled() {
+		l = tls.NewListener(l, web.serverTLS())
+		scheme = "https"
+	}
 
 	running.Add(1)
 	go func() {
 		defer running.Done()
 		<-quit.Done()
-		err := srv.Shutdown(timeoutNoCancel(context.Background(), time.Minute))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		err := srv.Shutdown(ctx)
 		if err != http.ErrServerClosed {
 			log.Printf("HTTP shutdown, returned error: %v\n", err)
 		}
@@ -185,7 +335,7 @@ func startServer(quit context.Context, srv *http.Server) error {
 	running.Add(1)
 	go func() {
 		defer running.Done()
-		log.Printf("starting http server on %s\n", srv.Addr)
+		log.Printf("starting %s server on %s\n", scheme, srv.Addr)
 		err := srv.Serve(l)
 		if err != http.ErrServerClosed {
 			log.Printf("HTTP serve error: %v\n", err)
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics about the exporter itself, on /metrics
+var (
+	walksStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "walks_started_total",
+		Help:      "Walks of the task API started, by kind of walk",
+	}, []string{"walk"})
+	walksFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "walks_total",
+		Help:      "Walks of the task API finished, by kind of walk and result",
+	}, []string{"walk", "result"})
+	walkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "walk_duration_seconds",
+		Help:      "Time taken by walks of the task API",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"walk"})
+	walkLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time the last successful walk finished",
+	}, []string{"walk"})
+	pagesFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "pages_fetched_total",
+		Help:      "Pages of tasks fetched from the API",
+	})
+	tasksFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "tasks_fetched_total",
+		Help:      "Tasks fetched from the API",
+	})
+	cacheWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "tasks_written_total",
+		Help:      "Tasks written to a cache view",
+	}, []string{"view"})
+	cacheSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "tasks_skipped_total",
+		Help:      "Tasks not written to a cache view for being older than the cached one",
+	}, []string{"view"})
+	apiLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of each API request attempt, status is error when there was no response",
+	}, []string{"method", "endpoint", "status"})
+
+	cacheEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "entries"),
+		"Entries in a cache view",
+		[]string{"view"}, nil)
+)
+
+// trackWalk runs a walk of the task API, counting and timing it
+func trackWalk(walk string, fn func() error) error {
+	walksStarted.WithLabelValues(walk).Inc()
+	start := time.Now()
+	err := fn()
+	walkDuration.WithLabelValues(walk).Observe(time.Since(start).Seconds())
+	if err != nil {
+		walksFinished.WithLabelValues(walk, "failure").Inc()
+		return err
+	}
+	walksFinished.WithLabelValues(walk, "success").Inc()
+	walkLastSuccess.WithLabelValues(walk).SetToCurrentTime()
+	return nil
+}
+
+// endpointIDs matches path segments that are ids, such as tenant uuids and
+// v1 group ids, but not api versions
+var endpointIDs = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9]{3,})$`)
+
+// endpointLabel replaces the ids in a path, to keep one series per endpoint
+func endpointLabel(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if endpointIDs.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// observeAPIRequest records the latency of a single request attempt
+func observeAPIRequest(method, path string, resp *http.Response, took time.Duration) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	apiLatency.WithLabelValues(method, endpointLabel(path), status).Observe(took.Seconds())
+}
+
+// cacheEntries counts the entries of each view on scrape
+type cacheEntries []cacheConfig
+
+func (c cacheEntries) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntriesDesc
+}
+
+func (c cacheEntries) Collect(ch chan<- prometheus.Metric) {
+	for _, cfg := range c {
+		count, err := cfg.store.Count()
+		if err != nil {
+			log.Printf("problem counting %s cache: %v", cfg.view, err)
+			ch <- prometheus.NewInvalidMetric(cacheEntriesDesc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc,
+			prometheus.GaugeValue, float64(count), cfg.view)
+	}
+}
+
+// selfCollectors are the metrics about the exporter itself
+func selfCollectors(views ...cacheConfig) []prometheus.Collector {
+	return []prometheus.Collector{
+		walksStarted, walksFinished, walkDuration, walkLastSuccess,
+		pagesFetched, tasksFetched, cacheWritten, cacheSkipped, apiLatency,
+		jobRuns, jobFailures,
+		cacheEntries(views),
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -10,7 +11,33 @@ import (
 
 const namespace = "acronis"
 
-func probeHandler(path targetToCachePathFunc) http.Handler {
+// taskDurations is the fleet-wide run time of completed policy runs,
+// observed once per task as it's ingested
+var taskDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "task_run_duration_seconds",
+	Help:      "Run time of completed policy runs by policy type",
+	Buckets:   prometheus.ExponentialBuckets(60, 2, 12),
+}, []string{"policyType"})
+
+// observeTaskDuration adds finished tasks to a duration histogram
+func observeTaskDuration(histogram *prometheus.HistogramVec) taskPipelineFunc {
+	return func(t Task) error {
+		if d := t.Duration(); d > 0 {
+			histogram.WithLabelValues(t.Policy.Type).Observe(d.Seconds())
+		}
+		return nil
+	}
+}
+
+// probeExtraFunc adds more metrics about a found task to a probe's registry,
+// showing no more than the caller's scope
+type probeExtraFunc func(registry *prometheus.Registry, task Task, scope *tenantScope) error
+
+// probeHandler probes the task cached for a target. When store has no task,
+// extras still run on the task of fallback if it has one, such as a first
+// run still in progress.
+func probeHandler(store, fallback taskStore, fresh freshness, extras ...probeExtraFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		registry := prometheus.NewRegistry()
@@ -35,18 +62,52 @@ func probeHandler(path targetToCachePathFunc) http.Handler {
 		}
 
 		target := tgtStr(r.URL.Query().Get("target"))
+		if err = target.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("invalid target: %v", err), http.StatusBadRequest)
+			return
+		}
 
-		task, err := readTask(path(target))
+		scope := scopeFrom(r.Context())
+		task, err := store.Get(target)
 
 		if err != nil {
 			task.Result.Code = "nomatch"
 			probeSuccess.Set(0)
+			if fallback != nil {
+				if other, err := fallback.Get(target); err == nil {
+					if !scope.allows(other) {
+						http.Error(w, "target outside of token scope", http.StatusForbidden)
+						return
+					}
+					for _, extra := range extras {
+						if err = extra(registry, other, scope); err != nil {
+							http.Error(w, "", http.StatusInternalServerError)
+							return
+						}
+					}
+				}
+			}
 		} else {
+			if !scope.allows(task) {
+				http.Error(w, "target outside of token scope", http.StatusForbidden)
+				return
+			}
 			probeSuccess.Set(1)
+			task = fresh.check(task, start)
 			if err = taskToRegistry(registry, task); err != nil {
 				http.Error(w, "", http.StatusInternalServerError)
 				return
 			}
+			if err = ageToRegistry(registry, task, fresh.limit(task), start); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			for _, extra := range extras {
+				if err = extra(registry, task, scope); err != nil {
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+			}
 		}
 
 		if err = registry.Register(registerPolicyState(task)); err != nil {
@@ -63,19 +124,27 @@ func registerPolicyState(task Task) prometheus.Gauge {
 	policyState := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "policy_state",
-		Help:      "OK=0 WARNING=1 ERROR=2 UNKNOWN=3",
+		Help:      "OK=0 WARNING=1 ERROR=2 UNKNOWN=3 STALE=4",
 	})
 
+	policyState.Set(policyStateValue(task))
+	return policyState
+}
+
+// policyStateValue maps the result of a task to OK=0 WARNING=1 ERROR=2 UNKNOWN=3,
+// or STALE=4 when the task is too old to say anything about its policy
+func policyStateValue(task Task) float64 {
+	if task.Stale {
+		return float64(4)
+	}
 	if code, ok := map[string]int{
 		"ok":      0,
 		"warning": 1,
 		"error":   2,
 	}[task.Result.Code]; ok {
-		policyState.Set(float64(code))
-	} else {
-		policyState.Set(float64(3))
+		return float64(code)
 	}
-	return policyState
+	return float64(3)
 }
 
 func taskToRegistry(registry *prometheus.Registry, task Task) error {
@@ -128,7 +197,31 @@ func taskToRegistry(registry *prometheus.Registry, task Task) error {
 		})
 	lastRun.Set(float64(task.Updated.Unix()))
 
-	for _, gauge := range []prometheus.Collector{metadata, policyError, lastRun} {
+	collectors := []prometheus.Collector{metadata, policyError, lastRun}
+
+	if !task.Started.IsZero() {
+		started := prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "task_started_timestamp",
+				Help:      "Timestamp the last task started running",
+			})
+		started.Set(float64(task.Started.Unix()))
+		collectors = append(collectors, started)
+	}
+
+	if d := task.Duration(); d > 0 {
+		duration := prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "task_duration_seconds",
+				Help:      "Seconds the last task ran for",
+			})
+		duration.Set(d.Seconds())
+		collectors = append(collectors, duration)
+	}
+
+	for _, gauge := range collectors {
 		err := registry.Register(gauge)
 		if err != nil {
 			return err
@@ -136,3 +229,31 @@ func taskToRegistry(registry *prometheus.Registry, task Task) error {
 	}
 	return nil
 }
+
+// ageToRegistry adds how old the task is, and how old it may get if limited
+func ageToRegistry(registry *prometheus.Registry, task Task, limit time.Duration, now time.Time) error {
+	age := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "policy_data_age_seconds",
+		Help:      "Seconds since the last task of the policy was updated",
+	})
+	age.Set(now.Sub(task.Updated).Seconds())
+	collectors := []prometheus.Collector{age}
+
+	if limit > 0 {
+		maxAge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "policy_max_data_age_seconds",
+			Help:      "Data age after which the policy is reported stale",
+		})
+		maxAge.Set(limit.Seconds())
+		collectors = append(collectors, maxAge)
+	}
+
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
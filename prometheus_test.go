@@ -1,6 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -8,23 +20,27 @@ import (
 	"regexp"
 	"strconv"
 	"testing"
+	"time"
 
 	"io/ioutil"
 	"os"
 
+	"github.com/jarcoal/httpmock"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestProbeHandler(t *testing.T) {
 	ts := httptest.NewServer(probeHandler(
-		stdTargetToCachePathFunc("testdata/mock/byTask"),
+		newFSStore("testdata/mock/byTask"), nil, freshness{},
 	))
 	tsURL, err := url.Parse(ts.URL)
 	require.NoError(t, err)
 
-	regex, err := regexp.CompilePOSIX(`^probe_duration_seconds.*`)
+	regex, err := regexp.CompilePOSIX(`^(probe_duration_seconds|acronis_policy_data_age_seconds) .*`)
 	require.NoError(t, err)
 
 	for id, target := range testProbeHandler_testdata {
@@ -37,11 +53,20 @@ func TestProbeHandler(t *testing.T) {
 			defer resp.Body.Close()
 			respBytes, err := ioutil.ReadAll(resp.Body)
 			assert.NoError(t, err)
-			respBytes = regex.ReplaceAll(respBytes, []byte("probe_duration_seconds *"))
+			respBytes = regex.ReplaceAll(respBytes, []byte("$1 *"))
 
 			goldenAssert(t, name, respBytes)
 		})
 	}
+
+	for _, target := range []string{"", "a\x00b"} {
+		tsURL := *tsURL
+		tsURL.RawQuery = url.Values{"target": []string{target}}.Encode()
+		resp, err := http.Get(tsURL.String())
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "target %q", target)
+	}
 }
 
 func TestTaskToRegistry(t *testing.T) {
@@ -63,3 +88,725 @@ func TestTaskToRegistry(t *testing.T) {
 		})
 	}
 }
+
+func TestUsageHandler(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	api := acronisMockConn(t)
+
+	handler := usageHandler(&api, tree)
+
+	regex, err := regexp.CompilePOSIX(`^(probe_duration_seconds|acronis_policy_data_age_seconds) .*`)
+	require.NoError(t, err)
+
+	for name, target := range testUsageHandler_testdata {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet,
+				"/usages?"+url.Values{"target": []string{target}}.Encode(), nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			respBytes := regex.ReplaceAll(rec.Body.Bytes(), []byte("probe_duration_seconds *"))
+			goldenAssert(t, name, respBytes)
+		})
+	}
+}
+
+func TestUsageHandlerNoRetry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	api := acronisMockConn(t)
+	api.retry = newRetryPolicy(3, time.Millisecond, time.Second)
+	var calls int
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/2/tenants/usages"}).String(),
+		func(req *http.Request) (*http.Response, error) {
+			calls++
+			return httpmock.NewStringResponse(http.StatusServiceUnavailable, "{}"), nil
+		})
+
+	rec := httptest.NewRecorder()
+	usageHandler(&api, tree).ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usages?target=1ca2ea47-e6f1-48af-9328-41757c298d03", nil))
+	assert.Contains(t, rec.Body.String(), "probe_success 0")
+	assert.Equal(t, 1, calls, "a scrape never retries")
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	for header, exp := range map[string]time.Duration{
+		"":      time.Minute,
+		"soon":  time.Minute,
+		"-1":    time.Minute,
+		"10":    9500 * time.Millisecond,
+		"0.25":  250 * time.Millisecond,
+		"86400": time.Minute,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/usages", nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		assert.Equal(t, exp, scrapeTimeout(r, time.Minute), header)
+	}
+}
+
+func TestPolicyCollector(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	for name, td := range testPolicyCollector_testdata {
+		t.Run(name, func(t *testing.T) {
+			name, td := name, td
+			registry := prometheus.NewRegistry()
+			filename := filepath.Join(tempdir, name+".prom")
+
+			cfg := cacheByPolicy("byPolicy", newFSStore("testdata/mock/byPolicy"))
+			registry.MustRegister(newPolicyCollector(cfg, freshness{}, td.maxPolicies, td.maxAge))
+			assert.NoError(t, prometheus.WriteToTextfile(filename, registry))
+
+			assertGoldenFile(t, filename)
+		})
+	}
+}
+
+func TestSDHandler(t *testing.T) {
+	cfg := cacheByPolicy("byPolicy", newFSStore("testdata/mock/byPolicy"))
+
+	rec := httptest.NewRecorder()
+	sdHandler(cfg, cfg.taskToTarget, sdPolicyLabels).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd/byPolicy", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	readerGoldenAssert(t, "byPolicy.json", rec.Body)
+}
+
+// gatherValues flattens a registry to metric name and value, for registries
+// with a single series per metric
+func gatherValues(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	ret := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			ret[family.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+	return ret
+}
+
+func TestRunningProbeExtra(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	cfg := cacheByPolicy("byPolicy", newFSStore(tempdir))
+
+	for name, td := range testRunningProbeExtra_testdata {
+		t.Run(name, func(t *testing.T) {
+			var task Task
+			task.Policy.ID = name
+			if td.state != "" {
+				running := task
+				running.State = td.state
+				running.Started = time.Now().Add(-td.elapsed)
+				require.NoError(t, writeTask(running, cfg))
+			}
+
+			registry := prometheus.NewRegistry()
+			require.NoError(t, runningProbeExtra(cfg, 24*time.Hour)(registry, task, nil))
+
+			values := gatherValues(t, registry)
+			assert.Equal(t, td.running, values["acronis_task_running"])
+			assert.Equal(t, td.enqueued, values["acronis_task_enqueued"])
+			assert.Equal(t, td.stuck, values["acronis_task_stuck"])
+			if td.state == "running" {
+				assert.InDelta(t, td.elapsed.Seconds(), values["acronis_task_running_seconds"], 5)
+			} else {
+				assert.NotContains(t, values, "acronis_task_running_seconds")
+			}
+		})
+	}
+}
+
+func TestProbeRunningFallback(t *testing.T) {
+	policyCfg := cacheByPolicy("byPolicy", newMemoryStore())
+	runningCfg := cacheByPolicy("running", newMemoryStore())
+
+	// the first run of a new policy, stuck before it ever completed
+	var task Task
+	task.Policy.ID = "new-policy"
+	task.State = "running"
+	task.Started = time.Now().Add(-30 * time.Hour)
+	require.NoError(t, writeTask(task, runningCfg))
+
+	probe := probeHandler(policyCfg.store, runningCfg.store, freshness{},
+		runningProbeExtra(runningCfg, 24*time.Hour))
+	rec := httptest.NewRecorder()
+	probe.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/byPolicy?target=new-policy", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "probe_success 0")
+	assert.Contains(t, body, "acronis_task_running 1")
+	assert.Contains(t, body, "acronis_task_stuck 1")
+
+	rec = httptest.NewRecorder()
+	probe.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/byPolicy?target=other-policy", nil))
+	assert.NotContains(t, rec.Body.String(), "acronis_task_running")
+}
+
+func TestObserveTaskDuration(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	cfg := cacheByPolicy("byPolicy", newFSStore(tempdir))
+
+	task, err := readTask("testdata/mock/byTask/a4c2e1d0-6b3f-4e8a-9c57-2d1f0b8e6a34.json")
+	require.NoError(t, err)
+
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "test_duration_seconds",
+	}, []string{"policyType"})
+	pipeline := multiTaskPipelineFunc(
+		filterUnseen(cfg, observeTaskDuration(histogram)),
+		writeTaskPipeline(cfg),
+	)
+
+	// the same task seen again, such as from an overlapping poll, counts once
+	require.NoError(t, pipeline(task))
+	require.NoError(t, pipeline(task))
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(histogram))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	h := families[0].GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(1), h.GetSampleCount())
+	assert.Equal(t, task.Duration().Seconds(), h.GetSampleSum())
+}
+
+func TestHistoryProbeExtra(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	store := newFSHistory(tempdir)
+
+	for name, td := range testHistoryProbeExtra_testdata {
+		t.Run(name, func(t *testing.T) {
+			var task Task
+			task.Policy.ID = name
+			record := recordHistory(store, 4)
+			last := time.Now().Add(-time.Hour)
+			for i, result := range td.results {
+				run := task
+				run.UUID = strconv.Itoa(i)
+				run.Updated = last.Add(-time.Duration(len(td.results)-1-i) * 24 * time.Hour)
+				run.Result.Code = result
+				// overlapping polls see the same run more than once
+				require.NoError(t, record(run))
+				require.NoError(t, record(run))
+			}
+
+			history, err := store.Get(tgtStr(task.Policy.ID))
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(history.Runs), 4)
+
+			registry := prometheus.NewRegistry()
+			windows := []time.Duration{48 * time.Hour, 168 * time.Hour}
+			require.NoError(t, historyProbeExtra(store, windows)(registry, task, nil))
+
+			families, err := registry.Gather()
+			require.NoError(t, err)
+			values := map[string]float64{}
+			for _, family := range families {
+				for _, m := range family.GetMetric() {
+					key := family.GetName()
+					for _, label := range m.GetLabel() {
+						key += "/" + label.GetValue()
+					}
+					values[key] = m.GetGauge().GetValue()
+				}
+			}
+			assert.Equal(t, td.failures, values["acronis_policy_consecutive_failures"])
+			assert.Equal(t, td.ratio2d, values["acronis_policy_success_ratio/2d"])
+			assert.Equal(t, td.ratio7d, values["acronis_policy_success_ratio/7d"])
+			if td.success {
+				assert.Contains(t, values, "acronis_policy_last_success_timestamp")
+			} else {
+				assert.NotContains(t, values, "acronis_policy_last_success_timestamp")
+			}
+		})
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	task, err := readTask("testdata/mock/byTask/a4c2e1d0-6b3f-4e8a-9c57-2d1f0b8e6a34.json")
+	require.NoError(t, err)
+
+	for name, td := range testFreshness_testdata {
+		t.Run(name, func(t *testing.T) {
+			fresh, err := newFreshness(td.maxAge, td.byType)
+			require.NoError(t, err)
+
+			checked := fresh.check(task, task.Updated.Add(td.age))
+			assert.Equal(t, td.stale, checked.Stale)
+			assert.Equal(t, td.stale, policyStateValue(checked) == 4)
+
+			registry := prometheus.NewRegistry()
+			require.NoError(t, ageToRegistry(registry, checked, fresh.limit(task), task.Updated.Add(td.age)))
+			values := gatherValues(t, registry)
+			assert.Equal(t, td.age.Seconds(), values["acronis_policy_data_age_seconds"])
+			assert.Equal(t, fresh.limit(task).Seconds(), values["acronis_policy_max_data_age_seconds"])
+		})
+	}
+
+	_, err = newFreshness(0, map[string]string{"backup": "weekly"})
+	assert.Error(t, err)
+}
+
+func TestSelfMetrics(t *testing.T) {
+	for path, exp := range testEndpointLabel_testdata {
+		assert.Equal(t, exp, endpointLabel(path), path)
+	}
+
+	require.NoError(t, trackWalk("test", func() error { return nil }))
+	assert.Equal(t, assert.AnError, trackWalk("test", func() error { return assert.AnError }))
+	assert.Equal(t, float64(2), testutil.ToFloat64(walksStarted.WithLabelValues("test")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(walksFinished.WithLabelValues("test", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(walksFinished.WithLabelValues("test", "failure")))
+
+	older, err := readTask("testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json")
+	require.NoError(t, err)
+	newer, err := readTask("testdata/mock/byTask/391cf484-f9a9-4491-b379-d18cec00fa55.json")
+	require.NoError(t, err)
+	cfg := cacheByPolicy("selfMetrics", newMemoryStore())
+	update := updateTaskPipeline(cfg)
+	require.NoError(t, update(newer))
+	require.NoError(t, update(older))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cacheWritten.WithLabelValues("selfMetrics")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cacheSkipped.WithLabelValues("selfMetrics")))
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(cacheEntries{cfg}))
+	assert.Equal(t, float64(1), gatherValues(t, registry)["acronis_cache_entries"])
+}
+
+func TestReadiness(t *testing.T) {
+	auth := &tokenSource{}
+	poll := newScheduledJob("poll", time.Hour, 0, time.Minute, func() error { return nil })
+	runningJob := newScheduledJob("running", time.Minute*5, 0, time.Minute, func() error { return nil })
+	ready := readyHandler(readiness{
+		auth:       auth,
+		threshold:  3,
+		staleAfter: 3,
+		backfill:   poll,
+		jobs:       []*scheduledJob{poll, runningJob},
+	})
+	check := func() (int, healthStatus) {
+		rec := httptest.NewRecorder()
+		ready.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		var status healthStatus
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+		return rec.Code, status
+	}
+
+	// nothing has happened yet
+	code, status := check()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", status.Status)
+	assert.Equal(t, componentStatus{Detail: "no valid token yet"}, status.Components["auth"])
+	assert.Equal(t, componentStatus{Detail: "not finished yet"}, status.Components["backfill"])
+	assert.True(t, status.Components["poll"].OK)
+
+	auth.token, auth.expires = "t", time.Now().Add(time.Hour).Unix()
+	poll.run()
+	runningJob.run()
+	code, status = check()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", status.Status)
+	assert.NotNil(t, status.Components["running"].LastSuccess)
+
+	// a refresh that hasn't succeeded in a while
+	runningJob.lastSuccess = time.Now().Add(-time.Hour)
+	code, status = check()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Components["running"].OK)
+	assert.Contains(t, status.Components["running"].Detail, "no successful run in")
+	assert.True(t, status.Components["backfill"].OK)
+
+	// anonymous requests only get the components and whether each is ok
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/-/ready", nil)
+	ready.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), anonymousKey{}, true)))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"status":"not ready","components":{"auth":{"ok":true},"backfill":{"ok":true},"poll":{"ok":true},"running":{"ok":false}}}`,
+		rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	healthyHandler(time.Now()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"healthy"`)
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir
+func writeTestCert(t *testing.T, dir string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "server.crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "server.key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	writeTestCert(t, dir, 1)
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	tokenHash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	scopedHash, err := bcrypt.GenerateFromPassword([]byte("reseller"), bcrypt.MinCost)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "web.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+tls_server_config:
+  cert_file: `+filepath.Join(dir, "server.crt")+`
+  key_file: `+filepath.Join(dir, "server.key")+`
+basic_auth_users:
+  alice: `+string(passHash)+`
+bearer_tokens:
+  - name: prometheus
+    token_hash: `+string(tokenHash)+`
+  - name: reseller
+    token_hash: `+string(scopedHash)+`
+    subtrees: [c8e6259d-a4d7-4ffc-8614-79c1d143cc54]
+`), 0600))
+
+	web, err := loadWebConfig(path)
+	require.NoError(t, err)
+	require.True(t, web.tlsEnabled())
+
+	srv := httptest.NewUnstartedServer(web.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case anonymous(r.Context()):
+			w.WriteHeader(http.StatusNoContent)
+		case scopeFrom(r.Context()) != nil:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}), nil, "/-/"))
+	srv.TLS = web.serverTLS()
+	srv.StartTLS()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	get := func(path string, auth func(*http.Request)) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	basic := func(user, pass string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, pass) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", nil).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", basic("alice", "wrong")).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", basic("mallory", "hunter2")).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", bearer("wrong")).StatusCode)
+	assert.Equal(t, http.StatusOK, get("/byPolicy", basic("alice", "hunter2")).StatusCode)
+	assert.Equal(t, http.StatusOK, get("/byPolicy", bearer("s3cret")).StatusCode)
+	// open paths pass anyone, but only tell those who could get past auth
+	// more than whether it's ready
+	assert.Equal(t, http.StatusNoContent, get("/-/ready", nil).StatusCode)
+	assert.Equal(t, http.StatusNoContent, get("/-/ready", bearer("wrong")).StatusCode)
+	assert.Equal(t, http.StatusNoContent, get("/-/ready", bearer("reseller")).StatusCode)
+	assert.Equal(t, http.StatusOK, get("/-/ready", bearer("s3cret")).StatusCode)
+	// scoped tokens pass their scope on
+	assert.Equal(t, http.StatusAccepted, get("/byPolicy", bearer("reseller")).StatusCode)
+
+	resp := get("/-/ready", nil)
+	assert.Equal(t, int64(1), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// a new certificate is picked up without a restart
+	writeTestCert(t, dir, 2)
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "server.crt"), later, later))
+	resp = get("/-/ready", nil)
+	assert.Equal(t, int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// wrong credentials are remembered too
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", bearer("wrong")).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("/byPolicy", bearer("wrong")).StatusCode)
+	web.mu.Lock()
+	assert.True(t, web.rejected[sha256.Sum256([]byte("Bearer wrong"))])
+	web.mu.Unlock()
+
+	// a broken config keeps the last good one, and is read once until it changes
+	good, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte("basic_auth_users: [\n"), 0600))
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.Error(t, web.reload())
+	assert.NoError(t, web.reload())
+	assert.Equal(t, http.StatusOK, get("/byPolicy", bearer("s3cret")).StatusCode)
+
+	require.NoError(t, ioutil.WriteFile(path, good, 0600))
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.NoError(t, web.reload())
+	web.mu.Lock()
+	assert.Empty(t, web.rejected, "a new config checks credentials again")
+	web.mu.Unlock()
+}
+
+func TestUnknownUserHash(t *testing.T) {
+	// unknown users cost as much as real ones hashed at the default cost
+	cost, err := bcrypt.Cost([]byte(unknownUserHash))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+	assert.Equal(t, bcrypt.ErrMismatchedHashAndPassword,
+		bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte("hunter2")))
+}
+
+func TestWebConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	writeTestCert(t, dir, 1)
+	tlsFiles := "tls_server_config:\n  cert_file: " + filepath.Join(dir, "server.crt") +
+		"\n  key_file: " + filepath.Join(dir, "server.key") + "\n"
+
+	for name, raw := range map[string]string{
+		"unknown field":    "users: {}\n",
+		"missing cert":     "tls_server_config:\n  cert_file: nope.crt\n  key_file: nope.key\n",
+		"client auth type": tlsFiles + "  client_auth_type: Sometimes\n",
+		"no client CA":     tlsFiles + "  client_auth_type: RequireAndVerifyClientCert\n",
+		"no server cert":   "tls_server_config:\n  client_auth_type: RequireAnyClientCert\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "web.yml")
+			require.NoError(t, ioutil.WriteFile(path, []byte(raw), 0600))
+			_, err := loadWebConfig(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTenantScope(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	cfg := cacheByPolicy("byPolicy", newFSStore("testdata/mock/byPolicy"))
+	sd := sdHandler(cfg, cfg.taskToTarget, sdPolicyLabels)
+	probe := probeHandler(cfg.store, nil, freshness{})
+	bulk := bulkHandler(cfg, freshness{}, 0, 0)
+
+	for name, td := range testTenantScope_testdata {
+		t.Run(name, func(t *testing.T) {
+			ctx := withScope(context.Background(), newTenantScope(tree, td.tenants, td.subtrees))
+			allowed := map[string]bool{}
+			for _, id := range td.allowed {
+				allowed[id] = true
+			}
+
+			rec := httptest.NewRecorder()
+			sd.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd/byPolicy", nil).WithContext(ctx))
+			var groups []sdTargetGroup
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&groups))
+			var listed []string
+			for _, group := range groups {
+				listed = append(listed, group.Targets...)
+			}
+			assert.ElementsMatch(t, td.allowed, listed)
+
+			for _, id := range []string{"67DC1F51-DEF3-4654-BA09-454DABFEAC69", "FC1E08D9-A52D-4CD6-87A1-76E754D994ED"} {
+				rec = httptest.NewRecorder()
+				probe.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/byPolicy?target="+id, nil).WithContext(ctx))
+				if allowed[id] {
+					assert.Equal(t, http.StatusOK, rec.Code, id)
+				} else {
+					assert.Equal(t, http.StatusForbidden, rec.Code, id)
+				}
+			}
+
+			rec = httptest.NewRecorder()
+			bulk.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/policies", nil).WithContext(ctx))
+			assert.Contains(t, rec.Body.String(),
+				"acronis_bulk_policies_exported "+strconv.Itoa(len(td.allowed))+"\n")
+		})
+	}
+
+	// unscoped callers see everything, scoped ones nothing of the exporter itself
+	rec := httptest.NewRecorder()
+	sd.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd/byPolicy", nil))
+	var groups []sdTargetGroup
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&groups))
+	assert.Len(t, groups, 2)
+
+	metrics := unscopedOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec = httptest.NewRecorder()
+	ctx := withScope(context.Background(), newTenantScope(tree, nil, []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"}))
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+// mockTasks reads every mock task
+func mockTasks(t *testing.T) []Task {
+	paths, err := filepath.Glob("testdata/mock/byTask/*.json")
+	require.NoError(t, err)
+	var ret []Task
+	for _, path := range paths {
+		task, err := readTask(path)
+		require.NoError(t, err)
+		ret = append(ret, task)
+	}
+	return ret
+}
+
+func TestTenantProbeExtraScope(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	cfg := cacheByPolicy("byPolicy", newFSStore("testdata/mock/byPolicy"))
+	probe := probeHandler(cfg.store, nil, freshness{}, tenantProbeExtra(tree))
+
+	for name, td := range map[string]struct {
+		scope  *tenantScope
+		labels string
+	}{
+		"unscoped": {labels: `parentName="Liquid Web",tenantEnabled="true",tenantKind="customer",tenantPath="Liquid Web/C3R2PB"`},
+		"partner subtree": {
+			scope:  newTenantScope(tree, nil, []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"}),
+			labels: `parentName="Liquid Web",tenantEnabled="true",tenantKind="customer",tenantPath="Liquid Web/C3R2PB"`,
+		},
+		// a customer never sees the names of the partners above it
+		"customer": {
+			scope:  newTenantScope(tree, []string{"1ca2ea47-e6f1-48af-9328-41757c298d03"}, nil),
+			labels: `parentName="",tenantEnabled="true",tenantKind="customer",tenantPath="C3R2PB"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if td.scope != nil {
+				ctx = withScope(ctx, td.scope)
+			}
+			rec := httptest.NewRecorder()
+			probe.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+				"/byPolicy?target=67DC1F51-DEF3-4654-BA09-454DABFEAC69", nil).WithContext(ctx))
+			require.Equal(t, http.StatusOK, rec.Code)
+			assert.Contains(t, rec.Body.String(), "acronis_tenant_info{"+td.labels+`,tenantUuid="1ca2ea47-e6f1-48af-9328-41757c298d03"} 1`)
+		})
+	}
+}
+
+func TestMachineProbe(t *testing.T) {
+	cfg := cacheByMachine("byMachine", newMemoryStore())
+	pipeline := updateTaskPipeline(cfg)
+	tasks := mockTasks(t)
+	for _, task := range tasks {
+		require.NoError(t, pipeline(task))
+	}
+	// a second policy failing on the load balancer
+	failed := tasks[0]
+	failed.UUID = "0e5a7b52-1f4b-4a53-b2f9-7c0a1c3e9d11"
+	failed.Policy.ID, failed.Policy.Name, failed.Policy.Type = "B6A1F0C2-5D3E-4F7A-8C9B-1E2D3F4A5B6C", "Replication", "replication"
+	failed.Context.MachineName = "cloudvmlb.support.lwtraining.net"
+	failed.Result.Code = "error"
+	require.NoError(t, pipeline(failed))
+	// and tasks without a machine aren't cached
+	anon := tasks[0]
+	anon.Context.MachineName = ""
+	require.NoError(t, pipeline(anon))
+
+	handler := rollupProbeHandler("machine", listByMachine(cfg), freshness{})
+	regex, err := regexp.CompilePOSIX(`^(probe_duration_seconds) .*`)
+	require.NoError(t, err)
+
+	for name, target := range testMachineProbe_testdata {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+				"/byMachine?"+url.Values{"target": []string{target}}.Encode(), nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			goldenAssert(t, name, regex.ReplaceAll(rec.Body.Bytes(), []byte("$1 *")))
+		})
+	}
+
+	assert.Equal(t, 3., worstState(nil))
+	assert.Equal(t, 2., worstState([]Task{failed, tasks[0], {Stale: true}}))
+	assert.Equal(t, 4., worstState([]Task{tasks[0], {Stale: true}}))
+}
+
+func TestTenantProbe(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	cfg := cacheByTenantName("byTenant", newMemoryStore())
+	pipeline := updateTaskPipeline(cfg)
+	tasks := mockTasks(t)
+	for _, task := range tasks {
+		require.NoError(t, pipeline(task))
+	}
+	// another policy of C3R2PB failing, and one of its unit
+	var failed, unit Task
+	for _, task := range tasks {
+		if task.Tenant.Name == "C3R2PB" {
+			failed, unit = task, task
+		}
+	}
+	failed.Policy.ID, failed.Policy.Name = "B6A1F0C2-5D3E-4F7A-8C9B-1E2D3F4A5B6C", "Replication"
+	failed.Result.Code = "error"
+	require.NoError(t, pipeline(failed))
+	unit.Tenant.Name, unit.Tenant.ID = "Accounting", "1272640"
+	unit.Policy.ID, unit.Policy.Name = "3D9E7A1B-2C4F-4E6A-9B8D-7F1A2C3E4D5B", "Accounting Daily"
+	unit.Context.MachineName = "accounting.support.lwtraining.net"
+	unit.Result.Code = "warning"
+	require.NoError(t, pipeline(unit))
+
+	handler := rollupProbeHandler("tenant", listByTenant(cfg, tree), freshness{}, tenantRollupExtra(tree))
+	regex, err := regexp.CompilePOSIX(`^(probe_duration_seconds) .*`)
+	require.NoError(t, err)
+
+	for name, query := range testTenantProbe_testdata {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/byTenant?"+query.Encode(), nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			goldenAssert(t, name, regex.ReplaceAll(rec.Body.Bytes(), []byte("$1 *")))
+		})
+	}
+
+	// service discovery lists each tenant once
+	rec := httptest.NewRecorder()
+	sdHandler(cfg, tenantTarget, sdTenantLabels).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sd/byTenant", nil))
+	var groups []sdTargetGroup
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&groups))
+	var targets []string
+	for _, group := range groups {
+		targets = append(targets, group.Targets...)
+	}
+	assert.ElementsMatch(t, []string{"C3R2PB", "RZU0ND", "Accounting"}, targets)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy describes how AcronisAPI.Call retries idempotent requests.
+// The zero value makes a single attempt.
+type retryPolicy struct {
+	attempts int           // total attempts, including the first one
+	base     time.Duration // first backoff interval, doubled on each attempt
+	max      time.Duration // cap on a single backoff interval
+	budget   time.Duration // total time allowed across every attempt
+}
+
+func newRetryPolicy(attempts int, base, budget time.Duration) retryPolicy {
+	return retryPolicy{
+		attempts: attempts,
+		base:     base,
+		max:      time.Minute,
+		budget:   budget,
+	}
+}
+
+// idempotentMethods are safe to send more than once
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryableStatus reports if a response is worth trying again
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusNotImplemented)
+}
+
+// backoff decides whether attempt number `attempt` should be retried, and
+// how long to wait before doing so. elapsed is the time spent since the
+// first attempt started.
+func (p retryPolicy) backoff(
+	method string,
+	attempt int,
+	elapsed time.Duration,
+	resp *http.Response,
+	err error,
+) (time.Duration, bool) {
+	if attempt >= p.attempts || !idempotentMethods[method] {
+		return 0, false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	if err == nil && !retryableStatus(resp.StatusCode) {
+		return 0, false
+	}
+
+	wait := p.interval(attempt)
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = after
+		}
+	}
+
+	if p.budget > 0 && elapsed+wait > p.budget {
+		return 0, false
+	}
+	return wait, true
+}
+
+// interval is the jittered exponential backoff after the given attempt, no
+// wait at all without a base
+func (p retryPolicy) interval(attempt int) time.Duration {
+	if p.base <= 0 {
+		return 0
+	}
+	wait := p.base << uint(attempt-1)
+	// past the max, or overflowed by the shift
+	if wait > p.max || wait <= 0 {
+		wait = p.max
+	}
+	// jitter within the upper half of the interval
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfter parses a Retry-After header, which is either delay-seconds or
+// an HTTP-date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		wait := time.Until(when)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleepCtx waits for d, returning early with the context error if ctx ends
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// policyStateNames are the states of policyStateValue
+var policyStateNames = []string{"ok", "warning", "error", "unknown", "stale"}
+
+// stateSeverity orders the values of policyStateValue from best to worst
+var stateSeverity = map[float64]int{0: 0, 1: 1, 3: 2, 4: 3, 2: 4}
+
+// worstState is the worst policy state of some tasks, UNKNOWN without any
+func worstState(tasks []Task) float64 {
+	if len(tasks) == 0 {
+		return 3
+	}
+	worst := policyStateValue(tasks[0])
+	for _, task := range tasks[1:] {
+		if state := policyStateValue(task); stateSeverity[state] > stateSeverity[worst] {
+			worst = state
+		}
+	}
+	return worst
+}
+
+// listPoliciesFunc finds the tasks of every policy under a target, query
+// holds any options of the probe
+type listPoliciesFunc func(target tgtStr, query url.Values) ([]Task, error)
+
+// rollupExtraFunc adds more metrics about a probed set of policies, showing
+// no more than the caller's scope
+type rollupExtraFunc func(registry *prometheus.Registry, target tgtStr, tasks []Task, scope *tenantScope) error
+
+// rollupProbeHandler probes a set of policies, such as every policy of a
+// machine, with the state of each and the worst of them
+func rollupProbeHandler(subsystem string, list listPoliciesFunc, fresh freshness, extras ...rollupExtraFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		registry := prometheus.NewRegistry()
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Boolean if probe was successful",
+		})
+		probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "milliseconds for probe to respond",
+		})
+		for _, c := range []prometheus.Collector{probeSuccess, probeDurationGauge} {
+			if err := registry.Register(c); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		target := tgtStr(r.URL.Query().Get("target"))
+		if err := target.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("invalid target: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		found, err := list(target, r.URL.Query())
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		scope := scopeFrom(r.Context())
+		var tasks []Task
+		for _, task := range found {
+			if scope.allows(task) {
+				tasks = append(tasks, fresh.check(task, start))
+			}
+		}
+		if len(found) > 0 && len(tasks) == 0 {
+			http.Error(w, "target outside of token scope", http.StatusForbidden)
+			return
+		}
+
+		if len(tasks) > 0 {
+			probeSuccess.Set(1)
+		}
+		if err = rollupToRegistry(registry, subsystem, tasks); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		for _, extra := range extras {
+			if err = extra(registry, target, tasks, scope); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		probeDurationGauge.Set(float64(time.Since(start).Milliseconds()))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// rollupToRegistry adds the state and last run of each policy, how many
+// policies are in each state and the worst state of them
+func rollupToRegistry(registry *prometheus.Registry, subsystem string, tasks []Task) error {
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Policy.ID < tasks[j].Policy.ID })
+	labels := []string{"policyId", "policyName", "policyType", "machineName", "tenantName"}
+
+	policyState := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "policy_state",
+		Help:      "OK=0 WARNING=1 ERROR=2 UNKNOWN=3 STALE=4",
+	}, labels)
+	lastRun := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "lastrun_timestamp",
+		Help:      "Timestamp of last task run",
+	}, labels)
+	counts := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "policies",
+		Help:      "Count of policies by state",
+	}, []string{"state"})
+	worst := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "state",
+		Help:      "Worst state of every policy, OK=0 WARNING=1 ERROR=2 UNKNOWN=3 STALE=4",
+	})
+
+	for _, name := range policyStateNames {
+		counts.WithLabelValues(name)
+	}
+	for _, task := range tasks {
+		values := []string{task.Policy.ID, task.Policy.Name, task.Policy.Type,
+			task.Context.MachineName, task.Tenant.Name}
+		state := policyStateValue(task)
+		policyState.WithLabelValues(values...).Set(state)
+		lastRun.WithLabelValues(values...).Set(float64(task.Updated.Unix()))
+		counts.WithLabelValues(policyStateNames[int(state)]).Inc()
+	}
+	worst.Set(worstState(tasks))
+
+	for _, c := range []prometheus.Collector{policyState, lastRun, counts, worst} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
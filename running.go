@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	runningRefresh = kingpin.Flag("runningRefresh",
+		"interval to reload running and enqueued tasks, 0 disables it").
+		Default("5m").Duration()
+	stuckAfter = kingpin.Flag("stuckAfter",
+		"flag a task as stuck once it has been running this long").
+		Default("24h").Duration()
+)
+
+// refreshRunning replaces the running view with a snapshot of every running
+// and enqueued task. Tasks that have since finished are removed from it.
+func refreshRunning(ctx context.Context, api *AcronisAPI, cfg cacheConfig) error {
+	query := url.Values{}
+	query.Set("order", "asc(updatedAt)")
+	query.Set("state", "or(running,enqueued)")
+
+	// a policy can have a task running and another enqueued behind it, the
+	// running one is kept so it can still be flagged as stuck
+	keep := map[tgtStr]string{} // key to the state of the task kept
+	write := writeTaskPipeline(cfg)
+	err := api.walkTasks(ctx, query, 5000, func(t Task) error {
+		key := cfg.key(t)
+		if keep[key] == "running" && t.State != "running" {
+			return nil
+		}
+		keep[key] = t.State
+		return write(t)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var finished []tgtStr
+	err = cfg.store.List("", "", func(key tgtStr, _ Task) error {
+		if _, ok := keep[key]; !ok {
+			finished = append(finished, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range finished {
+		if err = cfg.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshRunningFunc creates a fn to reload the running view
+func refreshRunningFunc(walks *walkManager, api *AcronisAPI, cfg cacheConfig) func() error {
+	return func() error {
+		if !api.auth.Valid() {
+			return fmt.Errorf("problem refreshing running tasks, auth degraded: %v", api.auth.Err())
+		}
+		return walks.run(walkStatus{Kind: "running"}, lockRunning, func(ctx context.Context) error {
+			return refreshRunning(ctx, api, cfg)
+		})
+	}
+}
+
+// runningProbeExtra reports if the policy of a task has a run in progress,
+// how long it has been going, and if it has been going for too long.
+func runningProbeExtra(cfg cacheConfig, stuck time.Duration) probeExtraFunc {
+	return func(registry *prometheus.Registry, task Task, _ *tenantScope) error {
+		running := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_running",
+			Help:      "1 if the policy has a task running",
+		})
+		enqueued := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_enqueued",
+			Help:      "1 if the policy has a task waiting to run",
+		})
+		stuckGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_stuck",
+			Help:      "1 if the running task is over the stuck threshold",
+		})
+		collectors := []prometheus.Collector{running, enqueued, stuckGauge}
+
+		current, err := cfg.store.Get(tgtStr(task.Policy.ID))
+		if err != nil && err != errNotCached {
+			return err
+		}
+		if err == nil {
+			switch current.State {
+			case "running":
+				running.Set(1)
+			case "enqueued":
+				enqueued.Set(1)
+			}
+			if current.State == "running" && !current.Started.IsZero() {
+				elapsed := time.Since(current.Started)
+				startedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "task_running_started_timestamp",
+					Help:      "Start time of the running task",
+				})
+				startedGauge.Set(float64(current.Started.Unix()))
+				elapsedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "task_running_seconds",
+					Help:      "Time the running task has been going",
+				})
+				elapsedGauge.Set(elapsed.Seconds())
+				if stuck > 0 && elapsed > stuck {
+					stuckGauge.Set(1)
+				}
+				collectors = append(collectors, startedGauge, elapsedGauge)
+			}
+		}
+
+		for _, c := range collectors {
+			if err := registry.Register(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
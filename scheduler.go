@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	refreshJitter = kingpin.Flag("refreshJitter",
+		"fraction of an interval randomly added to each scheduled run").
+		Default("0.1").Float64()
+	refreshRetry = kingpin.Flag("refreshRetry",
+		"first wait before retrying a failed run, doubled on each failure up to the interval").
+		Default("1m").Duration()
+	unreadyAfter = kingpin.Flag("unreadyAfter",
+		"consecutive failed refreshes before reporting not ready, 0 never does").
+		Default("3").Int()
+)
+
+var (
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "runs_total",
+		Help:      "Scheduled runs by job and result, skipped when another walk held the lock",
+	}, []string{"job", "result"})
+	jobFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "consecutive_failures",
+		Help:      "Failed runs of a job since its last success",
+	}, []string{"job"})
+)
+
+// scheduledJob runs fn on a jittered interval, retrying failures sooner
+// with backoff. Runs of a job never overlap, the cache keeps serving while
+// it fails.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	jitter   float64
+	retry    retryPolicy
+	fn       func() error
+
+	mu sync.Mutex
+	jobState
+}
+
+// jobState is how a job has been doing
+type jobState struct {
+	started     time.Time // when the job was started, zero until then
+	failures    int       // in a row
+	lastErr     error
+	lastSuccess time.Time
+}
+
+func newScheduledJob(name string, interval time.Duration, jitter float64, retry time.Duration, fn func() error) *scheduledJob {
+	return &scheduledJob{
+		name:     name,
+		interval: interval,
+		jitter:   jitter,
+		retry:    retryPolicy{base: retry, max: interval},
+		fn:       fn,
+	}
+}
+
+// noErr adapts a fn that handles its own errors
+func noErr(fn func()) func() error {
+	return func() error {
+		fn()
+		return nil
+	}
+}
+
+// next is the wait before the next run, backing off while failing
+func (j *scheduledJob) next() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.failures > 0 && j.retry.base > 0 {
+		return j.retry.interval(j.failures)
+	}
+	wait := j.interval
+	if spread := int64(float64(j.interval) * j.jitter); spread > 0 {
+		wait += time.Duration(rand.Int63n(spread + 1))
+	}
+	return wait
+}
+
+// run runs the job once, recording how it went
+func (j *scheduledJob) run() {
+	err := j.fn()
+	if err == errWalkRunning || errors.Is(err, context.Canceled) {
+		log.Printf("skipped %s: %v", j.name, err)
+		jobRuns.WithLabelValues(j.name, "skipped").Inc()
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		j.failures++
+		j.lastErr = err
+		log.Printf("problem running %s, %d failures in a row: %v", j.name, j.failures, err)
+		jobRuns.WithLabelValues(j.name, "failure").Inc()
+	} else {
+		j.failures = 0
+		j.lastErr = nil
+		j.lastSuccess = time.Now()
+		jobRuns.WithLabelValues(j.name, "success").Inc()
+	}
+	jobFailures.WithLabelValues(j.name).Set(float64(j.failures))
+}
+
+// start runs the job until ctx ends, the first run is right away if now
+func (j *scheduledJob) start(ctx context.Context, now bool) {
+	j.mu.Lock()
+	j.started = time.Now()
+	j.mu.Unlock()
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		if now {
+			j.run()
+		}
+		for {
+			if err := sleepCtx(ctx, j.next()); err != nil {
+				return
+			}
+			j.run()
+		}
+	}()
+}
+
+// state is a copy of the job's state
+func (j *scheduledJob) state() jobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jobState
+}
+
+// failing returns the last error once the job has failed threshold times
+// in a row, nil otherwise or if threshold is 0
+func (j *scheduledJob) failing(threshold int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if threshold <= 0 || j.failures < threshold {
+		return nil
+	}
+	return fmt.Errorf("%s failed %d times in a row: %w", j.name, j.failures, j.lastErr)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// tenantScope limits a caller to some tenants. A nil scope sees everything.
+type tenantScope struct {
+	tree     *tenantTree
+	tenants  map[string]bool // tenants by uuid or v1 id
+	subtrees map[string]bool // tenants by uuid, along with every tenant below
+}
+
+func newTenantScope(tree *tenantTree, tenants, subtrees []string) *tenantScope {
+	ret := &tenantScope{tree: tree, tenants: map[string]bool{}, subtrees: map[string]bool{}}
+	for _, id := range tenants {
+		ret.tenants[id] = true
+	}
+	for _, id := range subtrees {
+		ret.subtrees[id] = true
+	}
+	return ret
+}
+
+// allowsTenant reports if a tenant, by uuid or v1 id, is in scope
+func (s *tenantScope) allowsTenant(id string) bool {
+	if s == nil || s.tenants[id] {
+		return true
+	}
+	if uuid, ok := s.tree.legacyID(id); ok && uuid != "" {
+		id = uuid
+	}
+	if s.tenants[id] || s.subtrees[id] {
+		return true
+	}
+	for _, parent := range s.tree.Ancestors(id) {
+		if s.subtrees[parent.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports if the tenant a task ran under is in scope
+func (s *tenantScope) allows(task Task) bool {
+	if s == nil || s.allowsTenant(task.Tenant.ID) {
+		return true
+	}
+	node, ok := s.tree.LookupTask(task)
+	return ok && s.allowsTenant(node.ID)
+}
+
+type scopeKey struct{}
+
+func withScope(ctx context.Context, scope *tenantScope) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+// scopeFrom finds the scope of the caller of a request, nil if unscoped
+func scopeFrom(ctx context.Context) *tenantScope {
+	scope, _ := ctx.Value(scopeKey{}).(*tenantScope)
+	return scope
+}
+
+// unscopedOnly rejects scoped callers, for endpoints that can't be filtered
+// down to some tenants
+func unscopedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scopeFrom(r.Context()) != nil {
+			http.Error(w, "not available to tenant scoped tokens", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
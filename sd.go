@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// sdTargetGroup is a single entry of the Prometheus http_sd format
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdLabelsFunc is the meta labels of a target, from one of its tasks
+type sdLabelsFunc func(Task) map[string]string
+
+func sdPolicyLabels(task Task) map[string]string {
+	return map[string]string{
+		"__meta_acronis_tenant_id":    task.Tenant.ID,
+		"__meta_acronis_tenant_name":  task.Tenant.Name,
+		"__meta_acronis_policy_id":    task.Policy.ID,
+		"__meta_acronis_policy_name":  task.Policy.Name,
+		"__meta_acronis_policy_type":  task.Policy.Type,
+		"__meta_acronis_machine_name": task.Context.MachineName,
+	}
+}
+
+func sdTenantLabels(task Task) map[string]string {
+	return map[string]string{
+		"__meta_acronis_tenant_id":   task.Tenant.ID,
+		"__meta_acronis_tenant_name": task.Tenant.Name,
+	}
+}
+
+func sdTaskLabels(task Task) map[string]string {
+	return map[string]string{
+		"__meta_acronis_tenant_id":    task.Tenant.ID,
+		"__meta_acronis_tenant_name":  task.Tenant.Name,
+		"__meta_acronis_task_type":    task.Type,
+		"__meta_acronis_machine_name": task.Context.MachineName,
+	}
+}
+
+// sdHandler lists every target in a cache in the Prometheus http_sd format,
+// so new protection plans get picked up without editing scrape configs.
+// Targets with several tasks, such as a tenant's policies, are listed once.
+// See https://prometheus.io/docs/prometheus/latest/http_sd/
+func sdHandler(cfg cacheConfig, target taskToTargetFunc, labels sdLabelsFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := scopeFrom(r.Context())
+		groups := []sdTargetGroup{}
+		seen := map[tgtStr]bool{}
+		err := cfg.walk(func(task Task) error {
+			if !scope.allows(task) || seen[target(task)] {
+				return nil
+			}
+			seen[target(task)] = true
+			groups = append(groups, sdTargetGroup{
+				Targets: []string{string(target(task))},
+				Labels:  labels(task),
+			})
+			return nil
+		})
+		if err != nil {
+			log.Printf("problem listing targets: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(groups)
+	})
+}
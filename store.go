@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/rogpeppe/go-internal/lockedfile"
+	"go.etcd.io/bbolt"
+)
+
+var cacheBackend = kingpin.Flag("cacheBackend",
+	"where to keep cached tasks: fs, memory or bolt").
+	Default("fs").Enum("fs", "memory", "bolt")
+
+// errNotCached is returned by a taskStore for a key it has no task for
+var errNotCached = errors.New("not in cache")
+
+// taskIndexFunc is the value a task is listed under in a secondary index
+type taskIndexFunc func(Task) string
+
+// taskIndexes are the secondary indexes every store can list tasks by
+var taskIndexes = map[string]taskIndexFunc{
+	"tenant":  func(t Task) string { return string(tenantTarget(t)) },
+	"policy":  func(t Task) string { return t.Policy.ID },
+	"machine": func(t Task) string { return t.Context.MachineName },
+}
+
+// taskStore keeps one task per key for a cache view
+type taskStore interface {
+	// Get returns the task for a key, errNotCached if there is none
+	Get(key tgtStr) (Task, error)
+	// Put stores a task, replacing any task already under its key
+	Put(key tgtStr, t Task) error
+	// CompareAndSet stores a task unless the one under its key was updated
+	// after it, and reports if it was stored
+	CompareAndSet(key tgtStr, t Task) (bool, error)
+	// List calls fn with every task. With an index, only tasks whose index
+	// value matches are listed. fn must not use the store.
+	List(index, value string, fn func(tgtStr, Task) error) error
+	// ListPrefix calls fn with every task whose key starts with prefix,
+	// without reading the others. fn must not use the store.
+	ListPrefix(prefix tgtStr, fn func(tgtStr, Task) error) error
+	// Delete removes the task for a key, if there is one
+	Delete(key tgtStr) error
+	// Count is the number of tasks stored
+	Count() (int, error)
+}
+
+// openStoreFunc opens the store of a named cache view
+type openStoreFunc func(view string) (taskStore, error)
+
+// openBackend prepares a storage backend in cacheDir, with the run history
+// of policies kept alongside the views. The returned fn closes it on
+// shutdown.
+func openBackend(backend, cacheDir string) (openStoreFunc, historyStore, func() error, error) {
+	noop := func() error { return nil }
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, nil, nil, err
+	}
+	switch backend {
+	case "memory":
+		return func(string) (taskStore, error) {
+			return newMemoryStore(), nil
+		}, newMemoryHistory(), noop, nil
+	case "bolt":
+		path := filepath.Join(cacheDir, "cache.db")
+		db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 10 * time.Second})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("problem opening %s: %w", path, err)
+		}
+		history, err := newBoltHistory(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, nil, err
+		}
+		return func(view string) (taskStore, error) {
+			return newBoltStore(db, view)
+		}, history, db.Close, nil
+	}
+	historyDir := filepath.Join(cacheDir, "history")
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		return nil, nil, nil, err
+	}
+	return func(view string) (taskStore, error) {
+		dir := filepath.Join(cacheDir, view)
+		return newFSStore(dir), os.MkdirAll(dir, 0755)
+	}, newFSHistory(historyDir), noop, nil
+}
+
+// indexFunc looks up a secondary index, nil when listing everything
+func indexFunc(index string) (taskIndexFunc, error) {
+	if index == "" {
+		return nil, nil
+	}
+	fn, ok := taskIndexes[index]
+	if !ok {
+		return nil, fmt.Errorf("unknown index %s", index)
+	}
+	return fn, nil
+}
+
+// fsStore is a directory of locked JSON files, one per key
+type fsStore struct {
+	dir  string
+	path targetToCachePathFunc
+}
+
+func newFSStore(dir string) *fsStore {
+	return &fsStore{dir: dir, path: stdTargetToCachePathFunc(dir)}
+}
+
+func (s *fsStore) Get(key tgtStr) (Task, error) {
+	t, err := readTask(s.path(key))
+	if os.IsNotExist(err) {
+		return Task{}, errNotCached
+	}
+	return t, err
+}
+
+// see https://github.com/golang/go/issues/33974 to convert this to `x/sync/lockedfile.OpenFile` when possible
+func (s *fsStore) Put(key tgtStr, t Task) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	f, err := lockedfile.OpenFile(
+		s.path(key),
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(t)
+}
+
+// CompareAndSet holds the file lock between reading and writing the task
+func (s *fsStore) CompareAndSet(key tgtStr, t Task) (bool, error) {
+	if err := key.validate(); err != nil {
+		return false, err
+	}
+	f, err := lockedfile.OpenFile(s.path(key), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var stored Task
+	err = json.NewDecoder(f).Decode(&stored)
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("problem reading %s: %w", key, err)
+	}
+	if err == nil && stored.Updated.After(t.Updated) {
+		return false, nil
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err = f.Truncate(0); err != nil {
+		return false, err
+	}
+	return true, json.NewEncoder(f).Encode(t)
+}
+
+// List reads every file, an index only filters what is passed to fn
+func (s *fsStore) List(index, value string, fn func(tgtStr, Task) error) error {
+	match, err := indexFunc(index)
+	if err != nil {
+		return err
+	}
+	return s.list("*.json", func(key tgtStr, task Task) error {
+		if match != nil && match(task) != value {
+			return nil
+		}
+		return fn(key, task)
+	})
+}
+
+// ListPrefix only reads the files of the prefix. Keys are encoded byte by
+// byte, so the file name of a key starts with the encoded prefix, and the
+// encoding leaves no glob patterns.
+func (s *fsStore) ListPrefix(prefix tgtStr, fn func(tgtStr, Task) error) error {
+	return s.list(prefix.key()+"*.json", fn)
+}
+
+// list calls fn with the task of every file matching pattern
+func (s *fsStore) list(pattern string, fn func(tgtStr, Task) error) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, pattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		key, err := targetFromKey(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return err
+		}
+		task, err := readTask(path)
+		if os.IsNotExist(err) || err == io.EOF {
+			// removed since it was listed, or still being created
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("problem reading %s: %w", path, err)
+		}
+		if err = fn(key, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsStore) Count() (int, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	return len(files), err
+}
+
+func (s *fsStore) Delete(key tgtStr) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// memoryStore keeps tasks in a map, for tests and deployments that can
+// afford a backfill on every start
+type memoryStore struct {
+	mu    sync.RWMutex
+	tasks map[tgtStr]Task
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{tasks: map[tgtStr]Task{}}
+}
+
+func (s *memoryStore) Get(key tgtStr) (Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tasks[key]
+	if !ok {
+		return Task{}, errNotCached
+	}
+	return t, nil
+}
+
+func (s *memoryStore) Put(key tgtStr, t Task) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[key] = t
+	return nil
+}
+
+func (s *memoryStore) CompareAndSet(key tgtStr, t Task) (bool, error) {
+	if err := key.validate(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.tasks[key]; ok && stored.Updated.After(t.Updated) {
+		return false, nil
+	}
+	s.tasks[key] = t
+	return true, nil
+}
+
+func (s *memoryStore) List(index, value string, fn func(tgtStr, Task) error) error {
+	match, err := indexFunc(index)
+	if err != nil {
+		return err
+	}
+	return s.list(func(key tgtStr, t Task) bool {
+		return match == nil || match(t) == value
+	}, fn)
+}
+
+func (s *memoryStore) ListPrefix(prefix tgtStr, fn func(tgtStr, Task) error) error {
+	return s.list(func(key tgtStr, _ Task) bool {
+		return strings.HasPrefix(string(key), string(prefix))
+	}, fn)
+}
+
+// list calls fn with a snapshot of the tasks keep matches, in key order
+func (s *memoryStore) list(keep func(tgtStr, Task) bool, fn func(tgtStr, Task) error) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.tasks))
+	snapshot := make(map[tgtStr]Task, len(s.tasks))
+	for key, t := range s.tasks {
+		if keep(key, t) {
+			keys = append(keys, string(key))
+			snapshot[key] = t
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(tgtStr(key), snapshot[tgtStr(key)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Delete(key tgtStr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, key)
+	return nil
+}
+
+func (s *memoryStore) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.tasks), nil
+}
@@ -4,17 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/alecthomas/kingpin"
 	"github.com/fatih/color"
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
 
+var taskWorkers = kingpin.Flag("workers",
+	"number of workers writing tasks to the cache").
+	Default("4").Int()
+
 type Task struct {
 	ID     int64  `json:"id"`
 	UUID   string `json:"uuid"`
@@ -33,6 +39,9 @@ type Task struct {
 		ProtectionPlanID string `json:"ProtectionPlanID"`
 	} `json:"context"`
 	Updated         time.Time `json:"updatedAt"`
+	Enqueued        time.Time `json:"enqueuedAt"`
+	Started         time.Time `json:"startedAt"`
+	Completed       time.Time `json:"completedAt"`
 	State           string    `json:"state"`
 	StartedByUser   string    `json:"startedByUser"`
 	CancelRequested bool      `json:"cancelRequested"`
@@ -47,26 +56,50 @@ type Task struct {
 			} `json:"context"`
 		} `json:"error"`
 	} `json:"result"`
+
+	// Stale is set by the cache GC on tasks past retention, never by the API
+	Stale bool `json:"stale,omitempty"`
 }
 
-// see https://github.com/golang/go/issues/33974 to convert this to `x/sync/lockedfile.OpenFile` when possible
+// Duration is how long the task ran for, 0 if it hasn't finished
+func (t Task) Duration() time.Duration {
+	if t.Started.IsZero() || t.Completed.IsZero() {
+		return 0
+	}
+	return t.Completed.Sub(t.Started)
+}
+
+// writeTask stores a task in a cache, skipping tasks without a usable key
 func writeTask(t Task, cfg cacheConfig) error {
-	filename := cfg.taskPath(t)
-	if filepath.Base(filename) == ".json" {
+	key := cfg.key(t)
+	if key.validate() != nil {
 		return nil
 	}
-
-	// color.Cyan("logging to disk - %s", filename)
-	f, err := lockedfile.OpenFile(
-		filename,
-		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
-		0644,
-	)
-	if err != nil {
+	if err := cfg.store.Put(key, t); err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(t)
+	cacheWritten.WithLabelValues(cfg.view).Inc()
+	return nil
+}
+
+// updateTaskPipeline stores tasks that are newer than the cached one
+func updateTaskPipeline(cfg cacheConfig) taskPipelineFunc {
+	return func(t Task) error {
+		key := cfg.key(t)
+		if key.validate() != nil {
+			return nil
+		}
+		stored, err := cfg.store.CompareAndSet(key, t)
+		if err != nil {
+			return err
+		}
+		if stored {
+			cacheWritten.WithLabelValues(cfg.view).Inc()
+		} else {
+			cacheSkipped.WithLabelValues(cfg.view).Inc()
+		}
+		return nil
+	}
 }
 
 // readTask reads a given Task from disk.
@@ -83,25 +116,90 @@ func readTask(path string) (Task, error) {
 	return t, err
 }
 
-func strInSlice(target string, list []string) bool {
-	for _, s := range list {
-		if s == target {
-			return true
-		}
+type taskPipelineFunc func(Task) error
+
+// walkPipelineFunc builds the pipeline of a single walk, for stages that
+// must stop along with it
+type walkPipelineFunc func(ctx context.Context) taskPipelineFunc
+
+// taskPool runs a pipeline on a fixed set of workers. Tasks with the same
+// shard key always go to the same worker, so writes to the same cache file
+// stay in order.
+type taskPool struct {
+	workers []chan Task
+	shard   taskToTargetFunc
+	pending sync.WaitGroup
+	running sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newTaskPool(workers int, shard taskToTargetFunc, next taskPipelineFunc) *taskPool {
+	if workers < 1 {
+		workers = 1
 	}
-	return false
+	pool := &taskPool{shard: shard}
+	for i := 0; i < workers; i++ {
+		in := make(chan Task, 64)
+		pool.workers = append(pool.workers, in)
+		pool.running.Add(1)
+		go func() {
+			defer pool.running.Done()
+			for t := range in {
+				// once something has failed, drain without processing
+				if pool.Err() == nil {
+					if err := next(t); err != nil {
+						pool.fail(err)
+					}
+				}
+				pool.pending.Done()
+			}
+		}()
+	}
+	return pool
 }
 
-func filterTaskState(states []string, in <-chan Task, out chan<- Task) {
-	defer close(out)
-	for t := range in {
-		if strInSlice(t.State, states) {
-			out <- t
-		}
+// submit queues a task on its worker. It's a taskPipelineFunc, returning the
+// first error from any worker so callers stop feeding a failed pool.
+func (p *taskPool) submit(t Task) error {
+	if err := p.Err(); err != nil {
+		return err
 	}
+	hash := fnv.New32a()
+	hash.Write([]byte(p.shard(t)))
+	p.pending.Add(1)
+	p.workers[hash.Sum32()%uint32(len(p.workers))] <- t
+	return nil
 }
 
-type taskPipelineFunc func(Task) error
+// wait blocks until every submitted task is done, returning the first error
+func (p *taskPool) wait() error {
+	p.pending.Wait()
+	return p.Err()
+}
+
+// close stops the workers once they have drained
+func (p *taskPool) close() {
+	for _, in := range p.workers {
+		close(in)
+	}
+	p.running.Wait()
+}
+
+func (p *taskPool) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *taskPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
 
 func writeTaskPipeline(cfg cacheConfig) taskPipelineFunc {
 	return func(task Task) error {
@@ -109,6 +207,35 @@ func writeTaskPipeline(cfg cacheConfig) taskPipelineFunc {
 	}
 }
 
+// ingestViews are the cache views ingested tasks are written to
+type ingestViews struct {
+	task, policy, tenant, machine, noPolicy cacheConfig
+	history                                 historyStore
+	historyRuns                             int
+}
+
+// ingestPipeline writes each task to the views it belongs in. A view never
+// replaces its task with an older one, so walks that overlap or arrive out
+// of order can't roll it back, and observe sees each task of a policy once,
+// never older ones. Tasks without a policy aren't observed, they have no
+// policy type to tell them apart by.
+func ingestPipeline(v ingestViews, observe taskPipelineFunc) taskPipelineFunc {
+	return multiTaskPipelineFunc(
+		updateTaskPipeline(v.task),
+		splitByPolicySet(
+			multiTaskPipelineFunc(
+				filterUnseen(v.policy, observe),
+				updateTaskPipeline(v.policy),
+				updateTaskPipeline(v.tenant),
+				updateTaskPipeline(v.machine),
+				recordHistory(v.history, v.historyRuns),
+			),
+			// manual backups, restores and agent updates
+			updateTaskPipeline(v.noPolicy),
+		),
+	)
+}
+
 func splitByPolicySet(policy, noPolicy taskPipelineFunc) taskPipelineFunc {
 	return func(t Task) error {
 		if t.Policy.ID == "" {
@@ -130,30 +257,44 @@ func multiTaskPipelineFunc(children ...taskPipelineFunc) taskPipelineFunc {
 	}
 }
 
-func filterUpdatesOnly(
-	cfg cacheConfig,
-	next taskPipelineFunc) taskPipelineFunc {
+// filterUnseen only passes on tasks newer than the cached one, and not the
+// cached task itself, for stages that must see each task once, such as
+// counting durations
+func filterUnseen(cfg cacheConfig, next taskPipelineFunc) taskPipelineFunc {
 	return func(t Task) error {
-		path := cfg.taskPath(t)
-		loaded, err := readTask(path)
-
-		if err != nil {
-			if os.IsNotExist(err) {
-				// if there was an error reading the other cause it's not there
-				return next(t)
-			}
-			// otherwise if there was an error reading it, just disregard
-			return err
-		}
-		if t.Updated.Before(loaded.Updated) {
-			// if its after what's on disk, just skip
+		loaded, err := cfg.store.Get(cfg.key(t))
+		if err == nil && (t.Updated.Before(loaded.Updated) ||
+			(loaded.UUID == t.UUID && loaded.Updated.Equal(t.Updated))) {
 			return nil
 		}
+		if err != nil && err != errNotCached {
+			return err
+		}
 		return next(t)
 	}
 }
 
-func (a *AcronisAPI) walkTasks(query url.Values, limit int, next taskPipelineFunc) error {
+// taskPage is a page of tasks, and the cursor of the page after it
+type taskPage struct {
+	tasks []Task
+	after string
+	err   error
+}
+
+// walkTasks passes every task matching query to next, a page at a time.
+// The following page is fetched while the current one is processed.
+// pageDone, if set, is called with the cursor of the following page and
+// the tasks of the page once every one has been passed on, and with "" after
+// the last page.
+// A query holding an `after` cursor resumes a previous walk. Cancelling
+// ctx stops the walk before the next page.
+func (a *AcronisAPI) walkTasks(
+	ctx context.Context,
+	query url.Values,
+	limit int,
+	next taskPipelineFunc,
+	pageDone func(after string, tasks []Task) error,
+) error {
 	var limitStr string
 	if query == nil {
 		query = url.Values{}
@@ -163,56 +304,70 @@ func (a *AcronisAPI) walkTasks(query url.Values, limit int, next taskPipelineFun
 	} else {
 		limitStr = "100"
 	}
-	query.Set("lod", "full")
-	query.Set("limit", limitStr)
-	query.Del("after")
-
-	var prev time.Time
-	ts := time.Now()
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	defer cancel()
-
-	newTasks, after, err := a.getTasks(ctx, query)
-	if err != nil {
-		return err
+	if after := query.Get("after"); after != "" {
+		query = url.Values{}
+		query.Set("after", after)
+	} else {
+		query.Set("lod", "full")
 	}
+	query.Set("limit", limitStr)
 
-	// FIXME: improve debugging logging?
-	afterAbrev := after
-	if len(afterAbrev) > 16 {
-		afterAbrev = afterAbrev[:16]
-	}
-	fmt.Fprintln(os.Stderr, color.CyanString(
-		"secs [%d] records [%d] after [%s] first ts [%s]\n",
-		int(ts.Sub(prev).Seconds()), len(newTasks), afterAbrev,
-		newTasks[0].Updated.Format(time.RFC3339)))
+	pages := make(chan taskPage, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(pages)
+		for {
+			tasks, after, err := a.getPage(ctx, query)
+			if err == nil {
+				pagesFetched.Inc()
+				tasksFetched.Add(float64(len(tasks)))
+				progressFrom(ctx).page(len(tasks))
+			}
+			select {
+			case pages <- taskPage{tasks: tasks, after: after, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil || after == "" {
+				return
+			}
+			query = url.Values{}
+			query.Set("after", after)
+			query.Set("limit", limitStr)
+		}
+	}()
 
-	for _, task := range newTasks {
-		if err = next(task); err != nil {
+	ts := time.Now()
+	for page := range pages {
+		if page.err != nil {
+			return page.err
+		}
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-	}
 
-	for after != "" {
-		prev = ts
+		// FIXME: improve debugging logging?
+		prev := ts
 		ts = time.Now()
+		afterAbrev, firstTs := page.after, "none"
+		if len(afterAbrev) > 16 {
+			afterAbrev = afterAbrev[:16]
+		}
+		if len(page.tasks) > 0 {
+			firstTs = page.tasks[0].Updated.Format(time.RFC3339)
+		}
 		fmt.Fprintln(os.Stderr, color.CyanString(
 			"secs [%d] records [%d] after [%s] first ts [%s]\n",
-			int(ts.Sub(prev).Seconds()), len(newTasks), after[:16],
-			newTasks[0].Updated.Format(time.RFC3339)))
+			int(ts.Sub(prev).Seconds()), len(page.tasks), afterAbrev, firstTs))
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-		defer cancel()
-		query = url.Values{}
-		query.Set("after", after)
-		query.Set("limit", limitStr)
-		newTasks, after, err = a.getTasks(ctx, query)
-		if err != nil {
-			return err
+		for _, task := range page.tasks {
+			if err := next(task); err != nil {
+				return err
+			}
 		}
-		for _, task := range newTasks {
-			if err = next(task); err != nil {
+		if pageDone != nil {
+			if err := pageDone(page.after, page.tasks); err != nil {
 				return err
 			}
 		}
@@ -220,6 +375,42 @@ func (a *AcronisAPI) walkTasks(query url.Values, limit int, next taskPipelineFun
 	return nil
 }
 
+// walkTasksConcurrently is walkTasks with next run on a pool of workers.
+// Every task of a page is finished before pageDone is called for it, and it
+// is never called for a page where any task failed.
+func (a *AcronisAPI) walkTasksConcurrently(
+	ctx context.Context,
+	query url.Values,
+	limit int,
+	workers int,
+	next taskPipelineFunc,
+	pageDone func(after string, tasks []Task) error,
+) error {
+	pool := newTaskPool(workers, tenantTarget, next)
+	defer pool.close()
+
+	err := a.walkTasks(ctx, query, limit, pool.submit, func(after string, tasks []Task) error {
+		if err := pool.wait(); err != nil {
+			return err
+		}
+		if pageDone != nil {
+			return pageDone(after, tasks)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return pool.wait()
+}
+
+// getPage gets a single page of tasks with its own timeout
+func (a *AcronisAPI) getPage(ctx context.Context, query url.Values) ([]Task, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+	return a.getTasks(ctx, query)
+}
+
 func (a *AcronisAPI) getTasks(ctx context.Context, query url.Values) ([]Task, string, error) {
 	var respData struct {
 		Tasks  []Task `json:"items"`
@@ -228,20 +419,13 @@ func (a *AcronisAPI) getTasks(ctx context.Context, query url.Values) ([]Task, st
 				After string `json:"after"`
 			} `json:"cursors"`
 		} `json:"paging"`
-		Error struct {
-			Message string `json:"message"`
-		} `json:"error"`
 	}
 
-	statusCode, err := a.Call(ctx, http.MethodGet, "api/task_manager/v2/tasks",
+	_, err := a.Call(ctx, http.MethodGet, "api/task_manager/v2/tasks",
 		nil, query, nil, &respData)
 	if err != nil {
 		return []Task{}, "", err
 	}
-	if statusCode != http.StatusOK {
-		return []Task{}, "", fmt.Errorf("error status %d : %s",
-			statusCode, respData.Error.Message)
-	}
 
 	return respData.Tasks, respData.Paging.Cursors.After, nil
 }
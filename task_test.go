@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/jarcoal/httpmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -15,24 +27,28 @@ import (
 func TestLive_AcronisAPI_walkTasks(t *testing.T) {
 	api := acronisLiveConn(t)
 
-	uuidCfg, err := cacheByUuid("testdata/cache/byTask")
+	openStore, history, _, err := openBackend("fs", "testdata/cache")
 	require.NoError(t, err)
-	policyCfg, err := cacheByPolicy("testdata/cache/byPolicy")
-	require.NoError(t, err)
-	tenantCfg, err := cacheByTenantName("testdata/cache/byTenant")
-	require.NoError(t, err)
-
-	cachePipeline := multiTaskPipelineFunc(
-		filterUpdatesOnly(uuidCfg, writeTaskPipeline(uuidCfg)),
-		filterUpdatesOnly(policyCfg, writeTaskPipeline(policyCfg)),
-		filterUpdatesOnly(policyCfg, writeTaskPipeline(tenantCfg)),
-	)
+	open := func(view string) taskStore {
+		store, err := openStore(view)
+		require.NoError(t, err)
+		return store
+	}
+	cachePipeline := ingestPipeline(ingestViews{
+		task:        cacheByUuid("byTask", open("byTask")),
+		policy:      cacheByPolicy("byPolicy", open("byPolicy")),
+		tenant:      cacheByTenantName("byTenant", open("byTenant")),
+		machine:     cacheByMachine("byMachine", open("byMachine")),
+		noPolicy:    cacheByMachineType("noPolicy", open("noPolicy")),
+		history:     history,
+		historyRuns: 10,
+	}, func(Task) error { return nil })
 
 	query := url.Values{}
 	query.Set("order", "asc(updatedAt)")
 	query.Set("updatedAt", "gt("+time.Now().Add(-48*time.Hour).Format(time.RFC3339)+")")
 	query.Set("state", "completed")
-	err = api.walkTasks(query, 5000, cachePipeline)
+	err = api.walkTasks(context.Background(), query, 5000, cachePipeline, nil)
 	assert.NoError(t, err)
 }
 
@@ -66,9 +82,9 @@ func TestWriteTask(t *testing.T) {
 			name, td := name, td
 			t.Parallel()
 
+			store := newFSStore(td.cacheDir)
 			cfg := cacheConfig{
-				cacheDir:     td.cacheDir,
-				targetToPath: stdTargetToCachePathFunc(td.cacheDir),
+				store:        store,
 				taskToTarget: func(task Task) tgtStr { return tgtStr(name) },
 			}
 			writePipeline := writeTaskPipeline(cfg)
@@ -79,7 +95,7 @@ func TestWriteTask(t *testing.T) {
 			err = writePipeline(task)
 			if td.expErr == "" {
 				assert.NoError(t, err)
-				assertGoldenFile(t, cfg.taskPath(task))
+				assertGoldenFile(t, store.path(cfg.key(task)))
 			} else {
 				assert.EqualError(t, err, td.expErr)
 			}
@@ -87,21 +103,28 @@ func TestWriteTask(t *testing.T) {
 	}
 }
 
-func TestFilterUpdatesOnly(t *testing.T) {
-	require.NoError(t, os.MkdirAll("testdata/cache/filterUpdates/", 0755))
-	for name, td := range testFilterTaskUpdatesOnly_testdata {
+func TestIngestPipelineUpdates(t *testing.T) {
+	require.NoError(t, os.MkdirAll("testdata/cache/ingestUpdates/", 0755))
+	for name, td := range testIngestPipelineUpdates_testdata {
 		t.Run(name, func(t *testing.T) {
 			name, td := name, td
 			t.Parallel()
 			var writeErr error
 
+			store := newFSStore(td.cacheDir)
 			cfg := cacheConfig{
-				cacheDir:     td.cacheDir,
-				targetToPath: stdTargetToCachePathFunc(td.cacheDir),
+				view:         "ingestUpdates",
+				store:        store,
 				taskToTarget: func(task Task) tgtStr { return tgtStr(name) },
 			}
-			writePipeline := multiTaskPipelineFunc(filterUpdatesOnly(cfg,
-				writeTaskPipeline(cfg)))
+			writePipeline := ingestPipeline(ingestViews{
+				task:     cacheByUuid("ingestUpdatesByTask", newMemoryStore()),
+				policy:   cfg,
+				tenant:   cacheByTenantName("ingestUpdatesByTenant", newMemoryStore()),
+				machine:  cacheByMachine("ingestUpdatesByMachine", newMemoryStore()),
+				noPolicy: cacheByMachineType("ingestUpdatesNoPolicy", newMemoryStore()),
+				history:  newMemoryHistory(),
+			}, func(Task) error { return nil })
 
 			var task Task
 			for _, taskPath := range td.taskPath {
@@ -116,10 +139,626 @@ func TestFilterUpdatesOnly(t *testing.T) {
 
 			if td.expErr == "" {
 				assert.NoError(t, writeErr)
-				assertGoldenFile(t, cfg.taskPath(task))
+				assertGoldenFile(t, store.path(cfg.key(task)))
 			} else {
 				assert.EqualError(t, writeErr, td.expErr)
 			}
 		})
 	}
 }
+
+func TestResumeCache(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	api := acronisMockConn(t)
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+
+	for name, td := range testResumeCache_testdata {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tempdir, name+".json")
+			mark, err := loadWatermark(path)
+			require.NoError(t, err)
+			mark.state = td.state
+			require.NoError(t, mark.save())
+
+			var count int
+			require.NoError(t, resumeCache(context.Background(), &api, func(Task) error {
+				count++
+				return nil
+			}, mark))
+			assert.Equal(t, 2, count)
+
+			// the watermark is saved, and the cursor cleared
+			loaded, err := loadWatermark(path)
+			require.NoError(t, err)
+			assert.True(t, td.expUpdated.Equal(loaded.state.Updated))
+			assert.Equal(t, "", loaded.state.After)
+			assert.Equal(t, "", loaded.resumeCursor(time.Hour))
+		})
+	}
+}
+
+func TestResumeCacheFailure(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	api := acronisMockConn(t)
+	workers := *taskWorkers
+	*taskWorkers = 4
+	defer func() { *taskWorkers = workers }()
+
+	// one page, oldest first, each tenant on a worker of its own
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tasks := []map[string]interface{}{
+		{"uuid": "failing", "tenant": map[string]string{"Name": "failing"}, "updatedAt": start.Add(time.Hour)},
+		{"uuid": "later", "tenant": map[string]string{"Name": "later"}, "updatedAt": start.Add(2 * time.Hour)},
+		{"uuid": "latest", "tenant": map[string]string{"Name": "latest"}, "updatedAt": start.Add(3 * time.Hour)},
+	}
+	var since []string
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/task_manager/v2/tasks"}).String(),
+		func(req *http.Request) (*http.Response, error) {
+			since = append(since, req.URL.Query().Get("updatedAt"))
+			return httpmock.NewJsonResponse(http.StatusOK, map[string]interface{}{"items": tasks})
+		})
+
+	mark := &watermark{state: ingestState{Updated: start}}
+
+	// the failing task only fails once the later ones are done
+	var later sync.WaitGroup
+	later.Add(2)
+	err := resumeCache(context.Background(), &api, func(task Task) error {
+		if task.UUID != "failing" {
+			later.Done()
+			return nil
+		}
+		done := make(chan struct{})
+		go func() { later.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return assert.AnError
+	}, mark)
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, start, mark.Updated(), "a page with a failed task doesn't move the watermark")
+
+	var mu sync.Mutex
+	var seen []string
+	require.NoError(t, resumeCache(context.Background(), &api, func(task Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, task.UUID)
+		return nil
+	}, mark))
+	assert.Contains(t, seen, "failing", "the failed task is read again")
+	require.Len(t, since, 2)
+	assert.Equal(t, since[0], since[1], "the resume starts where the failed walk did")
+	assert.True(t, start.Add(3*time.Hour).Equal(mark.Updated()))
+}
+
+func TestWatermarkSince(t *testing.T) {
+	mark := &watermark{}
+	assert.WithinDuration(t, time.Now().Add(-48*time.Hour),
+		mark.since(48*time.Hour, 720*time.Hour), time.Second)
+
+	mark.state.Updated = time.Now().Add(-3 * time.Hour)
+	assert.WithinDuration(t, mark.state.Updated.Add(-watermarkOverlap),
+		mark.since(48*time.Hour, 720*time.Hour), time.Second)
+
+	mark.state.Updated = time.Now().Add(-1000 * time.Hour)
+	assert.WithinDuration(t, time.Now().Add(-720*time.Hour),
+		mark.since(48*time.Hour, 720*time.Hour), time.Second)
+}
+
+func TestTaskPool(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]int64{}
+
+	pool := newTaskPool(4, tenantTarget, func(task Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[task.Tenant.Name] = append(seen[task.Tenant.Name], task.ID)
+		return nil
+	})
+	for i := int64(0); i < 300; i++ {
+		var task Task
+		task.ID = i
+		task.Tenant.Name = strconv.Itoa(int(i % 7))
+		require.NoError(t, pool.submit(task))
+	}
+	require.NoError(t, pool.wait())
+	pool.close()
+
+	// every task is processed, and each tenant's tasks in submitted order
+	var total int
+	for _, ids := range seen {
+		total += len(ids)
+		assert.True(t, sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }))
+	}
+	assert.Equal(t, 300, total)
+
+	failing := newTaskPool(2, tenantTarget, func(Task) error { return assert.AnError })
+	defer failing.close()
+	require.NoError(t, failing.submit(Task{}))
+	assert.Equal(t, assert.AnError, failing.wait())
+	assert.Equal(t, assert.AnError, failing.submit(Task{}))
+}
+
+func TestTargetKey(t *testing.T) {
+	for name, td := range testTargetKey_testdata {
+		t.Run(name, func(t *testing.T) {
+			err := td.target.validate()
+			if td.expErr != "" {
+				assert.EqualError(t, err, td.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, td.key, td.target.key())
+
+			path := stdTargetToCachePathFunc("cache")(td.target)
+			assert.Equal(t, "cache", filepath.Dir(path))
+
+			target, err := targetFromKey(td.key)
+			require.NoError(t, err)
+			assert.Equal(t, td.target, target)
+		})
+	}
+}
+
+func TestTaskStore(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+
+	for _, backend := range []string{"fs", "memory", "bolt"} {
+		t.Run(backend, func(t *testing.T) {
+			openStore, _, closeBackend, err := openBackend(backend, filepath.Join(tempdir, backend))
+			require.NoError(t, err)
+			defer closeBackend()
+			store, err := openStore("byPolicy")
+			require.NoError(t, err)
+
+			first, err := readTask("testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json")
+			require.NoError(t, err)
+			second, err := readTask("testdata/mock/byTask/391cf484-f9a9-4491-b379-d18cec00fa55.json")
+			require.NoError(t, err)
+			key := tgtStr(first.Policy.ID)
+
+			_, err = store.Get(key)
+			assert.Equal(t, errNotCached, err)
+
+			// the older task can't replace the newer one
+			stored, err := store.CompareAndSet(key, second)
+			require.NoError(t, err)
+			assert.True(t, stored)
+			stored, err = store.CompareAndSet(key, first)
+			require.NoError(t, err)
+			assert.False(t, stored)
+			got, err := store.Get(key)
+			require.NoError(t, err)
+			assert.Equal(t, second.UUID, got.UUID)
+
+			// a put always replaces it, and moves it in the indexes
+			moved := first
+			moved.Context.MachineName = "moved.example.com"
+			require.NoError(t, store.Put(key, moved))
+			require.NoError(t, store.Put("other/policy", second))
+
+			list := func(index, value string) []string {
+				var keys []string
+				require.NoError(t, store.List(index, value, func(key tgtStr, _ Task) error {
+					keys = append(keys, string(key))
+					return nil
+				}))
+				return keys
+			}
+			assert.ElementsMatch(t, []string{string(key), "other/policy"}, list("", ""))
+			assert.Equal(t, []string{string(key)}, list("machine", "moved.example.com"))
+			assert.Equal(t, []string{"other/policy"}, list("machine", second.Context.MachineName))
+			assert.Empty(t, list("tenant", "nobody"))
+
+			var prefixed []string
+			require.NoError(t, store.ListPrefix("other/", func(key tgtStr, _ Task) error {
+				prefixed = append(prefixed, string(key))
+				return nil
+			}))
+			assert.Equal(t, []string{"other/policy"}, prefixed)
+			assert.EqualError(t, store.List("missing", "", nil), "unknown index missing")
+
+			require.NoError(t, store.Delete(key))
+			require.NoError(t, store.Delete(key))
+			_, err = store.Get(key)
+			assert.Equal(t, errNotCached, err)
+			assert.Empty(t, list("machine", "moved.example.com"))
+
+			assert.Error(t, store.Put("", first))
+		})
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+
+	for _, backend := range []string{"fs", "memory", "bolt"} {
+		t.Run(backend, func(t *testing.T) {
+			_, history, closeBackend, err := openBackend(backend, filepath.Join(tempdir, backend))
+			require.NoError(t, err)
+			defer closeBackend()
+
+			_, err = history.Get("policy")
+			assert.Equal(t, errNotCached, err)
+
+			now := time.Now().UTC().Truncate(time.Second)
+			for i := 0; i < 4; i++ {
+				run := policyRun{UUID: strconv.Itoa(i), Updated: now.Add(time.Duration(i) * time.Hour), Result: "ok"}
+				require.NoError(t, history.Add("policy", run, 3))
+			}
+			got, err := history.Get("policy")
+			require.NoError(t, err)
+			require.Len(t, got.Runs, 3)
+			assert.Equal(t, "3", got.Runs[0].UUID, "newest first")
+			assert.Equal(t, "1", got.Runs[2].UUID)
+
+			require.NoError(t, history.Delete("policy"))
+			require.NoError(t, history.Delete("policy"))
+			_, err = history.Get("policy")
+			assert.Equal(t, errNotCached, err)
+		})
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	for name, td := range testCacheGC_testdata {
+		t.Run(name, func(t *testing.T) {
+			store := newMemoryStore()
+			now := time.Now()
+			for key, age := range td.ages {
+				var task Task
+				task.Updated = now.Add(-age)
+				require.NoError(t, store.Put(key, task))
+			}
+
+			var removed []string
+			views, err := gcViews(map[string]string{"byPolicy": "2160h"}, td.markStale, map[string]gcView{
+				"byPolicy": {cfg: cacheByPolicy("byPolicy", store), removed: func(key tgtStr) error {
+					removed = append(removed, string(key))
+					return nil
+				}},
+			})
+			require.NoError(t, err)
+			require.Len(t, views, 1)
+			require.NoError(t, views[0].collect(now))
+			// a second pass finds nothing more to do
+			require.NoError(t, views[0].collect(now))
+
+			var kept, stale []string
+			require.NoError(t, store.List("", "", func(key tgtStr, task Task) error {
+				kept = append(kept, string(key))
+				if task.Stale {
+					stale = append(stale, string(key))
+				}
+				return nil
+			}))
+			assert.Equal(t, td.expKept, kept)
+			assert.Equal(t, td.expStale, stale)
+			assert.ElementsMatch(t, td.expRemoved, removed)
+		})
+	}
+
+	_, err := gcViews(map[string]string{"byMissing": "1h"}, false, map[string]gcView{})
+	assert.EqualError(t, err, "problem with retention of byMissing: no such view")
+	_, err = gcViews(map[string]string{"byPolicy": "soon"}, false, map[string]gcView{"byPolicy": {}})
+	assert.Error(t, err)
+
+	// setting one view keeps the defaults of the others, 0 turns one off
+	views, err := gcViews(withDefaultRetention(map[string]string{"byPolicy": "720h", "noPolicy": "0"}), false,
+		map[string]gcView{"byPolicy": {}, "byTenant": {}, "byMachine": {}, "byTask": {}, "noPolicy": {}})
+	require.NoError(t, err)
+	retention := map[string]time.Duration{}
+	for _, view := range views {
+		retention[view.name] = view.retention
+	}
+	assert.Equal(t, map[string]time.Duration{
+		"byPolicy":  720 * time.Hour,
+		"byTenant":  2160 * time.Hour,
+		"byMachine": 2160 * time.Hour,
+		"byTask":    168 * time.Hour,
+	}, retention)
+}
+
+func TestWalkManager(t *testing.T) {
+	walks := newWalkManager(context.Background())
+	block := func(ctx context.Context) error {
+		<-ctx.Done()
+		return fmt.Errorf("problem walking: %w", ctx.Err())
+	}
+
+	status, err := walks.start(walkStatus{Kind: "test"}, lockTasks, block)
+	require.NoError(t, err)
+	assert.Equal(t, "running", status.State)
+
+	// the lock is held, but other locks are free
+	_, err = walks.start(walkStatus{Kind: "test"}, lockTasks, block)
+	assert.Equal(t, errWalkRunning, err)
+	assert.Equal(t, errWalkRunning, walks.run(walkStatus{Kind: "test"}, lockTasks, block))
+	assert.NoError(t, walks.run(walkStatus{Kind: "test"}, lockRunning, func(ctx context.Context) error {
+		progressFrom(ctx).page(3)
+		return nil
+	}))
+
+	assert.False(t, walks.cancel(status.ID+100))
+	assert.True(t, walks.cancel(status.ID))
+	assert.Eventually(t, func() bool {
+		return len(walks.list()) == 2 && walks.list()[0].State != "running"
+	}, time.Second, time.Millisecond*10)
+
+	list := walks.list()
+	assert.Equal(t, status.ID, list[0].ID)
+	assert.Equal(t, "cancelled", list[0].State)
+	assert.NotNil(t, list[0].Finished)
+	assert.Equal(t, "succeeded", list[1].State)
+	assert.Equal(t, int64(1), list[1].Pages)
+	assert.Equal(t, int64(3), list[1].Tasks)
+}
+
+func TestAdminHandler(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	api := acronisMockConn(t)
+	tempdir, err := ioutil.TempDir(os.TempDir(), t.Name())
+	require.NoError(t, err)
+	tree, err := loadTenantTree(filepath.Join(tempdir, "tenants.json"))
+	require.NoError(t, err)
+
+	var count int64
+	walks := newWalkManager(context.Background())
+	handler := adminHandler("s3cret", walks, &api, tree, func(context.Context) taskPipelineFunc {
+		return func(Task) error {
+			atomic.AddInt64(&count, 1)
+			return nil
+		}
+	})
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	finished := func() bool {
+		list := walks.list()
+		return len(list) > 0 && list[0].State != "running"
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/walks", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/walks", "wrong").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/admin/backfill", "s3cret").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/admin/walks", "s3cret").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/backfill?since=soon", "s3cret").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/admin/cancel?id=1", "s3cret").Code)
+
+	rec := do(http.MethodPost, "/admin/backfill?since=48h", "s3cret")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var started walkStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&started))
+	assert.Equal(t, "admin", started.Kind)
+	assert.Equal(t, "48h0m0s", started.Since)
+	require.Eventually(t, finished, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&count))
+
+	// tasks of other tenants are fetched, but not passed on
+	rec = do(http.MethodPost, "/admin/backfill?tenant=nobody", "s3cret")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Eventually(t, func() bool { return finished() && len(walks.list()) == 2 }, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&count))
+
+	rec = do(http.MethodGet, "/admin/walks", "s3cret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list []walkStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Len(t, list, 2)
+	assert.Equal(t, "nobody", list[0].Tenant)
+	assert.Equal(t, "succeeded", list[0].State)
+	assert.Equal(t, int64(2), list[0].Tasks)
+	assert.Equal(t, "succeeded", list[1].State)
+
+	// a tenant with a known v1 id is filtered by the API
+	tree.replace("1ca2ea47-e6f1-48af-9328-41757c298d03", map[string]tenantNode{
+		"1ca2ea47-e6f1-48af-9328-41757c298d03": {ID: "1ca2ea47-e6f1-48af-9328-41757c298d03", Name: "C3R2PB"},
+	})
+	tree.setLegacyID("1272636", "1ca2ea47-e6f1-48af-9328-41757c298d03")
+	var tenantIDs []string
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/task_manager/v2/tasks"}).String(),
+		func(req *http.Request) (*http.Response, error) {
+			tenantIDs = append(tenantIDs, req.URL.Query().Get("tenantId"))
+			return httpmock.NewJsonResponse(http.StatusOK, map[string]interface{}{"items": []Task{}})
+		})
+	for _, tenant := range []string{"C3R2PB", "1ca2ea47-e6f1-48af-9328-41757c298d03", "1272636", "nobody"} {
+		require.Equal(t, http.StatusAccepted, do(http.MethodPost, "/admin/backfill?tenant="+tenant, "s3cret").Code)
+		require.Eventually(t, finished, time.Second*5, time.Millisecond*10)
+	}
+	assert.Equal(t, []string{"1272636", "1272636", "1272636", ""}, tenantIDs)
+}
+
+func TestScheduledJob(t *testing.T) {
+	var result error
+	job := newScheduledJob("test", time.Hour, 0.1, time.Second, func() error { return result })
+
+	for i := 0; i < 20; i++ {
+		wait := job.next()
+		assert.True(t, wait >= time.Hour && wait <= time.Hour+6*time.Minute, wait)
+	}
+
+	// failures back off from the retry wait, and only fail past the threshold
+	result = assert.AnError
+	job.run()
+	job.run()
+	assert.True(t, job.next() <= 2*time.Second)
+	assert.NoError(t, job.failing(3))
+	assert.NoError(t, job.failing(0))
+	job.run()
+	assert.True(t, job.next() <= 4*time.Second)
+	assert.ErrorIs(t, job.failing(3), assert.AnError)
+
+	// overlapping and cancelled runs don't count either way
+	result = errWalkRunning
+	job.run()
+	result = fmt.Errorf("problem walking: %w", context.Canceled)
+	job.run()
+	assert.Error(t, job.failing(3))
+
+	result = nil
+	job.run()
+	assert.NoError(t, job.failing(1))
+	assert.True(t, job.next() >= time.Hour)
+
+	// ready fails only on sustained failures
+	ready := readiness{threshold: 2}
+	result = assert.AnError
+	job.run()
+	assert.True(t, ready.checkJob(job, time.Now()).OK)
+	job.run()
+	assert.False(t, ready.checkJob(job, time.Now()).OK)
+}
+
+func TestScheduledJobStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs int64
+	job := newScheduledJob("test", time.Millisecond*10, 0, 0, func() error {
+		atomic.AddInt64(&runs, 1)
+		return nil
+	})
+	job.start(ctx, true)
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&runs) >= 3 }, time.Second, time.Millisecond)
+	cancel()
+	running.Wait()
+}
+
+func TestSplitByPolicySet(t *testing.T) {
+	taskCfg := cacheByUuid("byTask", newMemoryStore())
+	policyCfg := cacheByPolicy("byPolicy", newMemoryStore())
+	noPolicyCfg := cacheByMachineType("noPolicy", newMemoryStore())
+	pipeline := multiTaskPipelineFunc(
+		updateTaskPipeline(taskCfg),
+		splitByPolicySet(updateTaskPipeline(policyCfg), updateTaskPipeline(noPolicyCfg)),
+	)
+
+	scheduled, err := readTask("testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json")
+	require.NoError(t, err)
+	restore := scheduled
+	restore.UUID = "5b2f8e1a-9c3d-4e7f-a6b0-1d2c3e4f5a6b"
+	restore.Type = "restore"
+	restore.Policy.ID, restore.Policy.Name, restore.Policy.Type = "", "", ""
+	restore.Result.Code = "error"
+	for _, task := range []Task{scheduled, restore} {
+		require.NoError(t, pipeline(task))
+	}
+
+	for _, uuid := range []string{scheduled.UUID, restore.UUID} {
+		_, err = taskCfg.store.Get(tgtStr(uuid))
+		assert.NoError(t, err, uuid)
+	}
+	count, err := policyCfg.store.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = noPolicyCfg.store.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// the restore is probed by machine and type
+	rec := httptest.NewRecorder()
+	probeHandler(noPolicyCfg.store, nil, freshness{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/noPolicy?"+url.Values{"target": {"cloudvmfileserver.support.lwtraining.net/restore"}}.Encode(), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "probe_success 1\n")
+	assert.Contains(t, rec.Body.String(), "acronis_policy_state 2\n")
+}
+
+func TestIngestPipeline(t *testing.T) {
+	views := ingestViews{
+		task:        cacheByUuid("ingestByTask", newMemoryStore()),
+		policy:      cacheByPolicy("ingestByPolicy", newMemoryStore()),
+		tenant:      cacheByTenantName("ingestByTenant", newMemoryStore()),
+		machine:     cacheByMachine("ingestByMachine", newMemoryStore()),
+		noPolicy:    cacheByMachineType("ingestNoPolicy", newMemoryStore()),
+		history:     newMemoryHistory(),
+		historyRuns: 10,
+	}
+	var observed []string
+	pipeline := ingestPipeline(views, func(t Task) error {
+		observed = append(observed, t.UUID)
+		return nil
+	})
+
+	newer, err := readTask("testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json")
+	require.NoError(t, err)
+	older := newer
+	older.UUID = "older"
+	older.Updated = newer.Updated.Add(-time.Hour)
+
+	// a restore, kept by machine and type but without a policy type
+	restore := newer
+	restore.UUID, restore.Type = "restore", "restore"
+	restore.Policy.ID, restore.Policy.Type = "", ""
+
+	// a backfill overlapping a poll sees tasks again and out of order
+	for _, task := range []Task{newer, older, newer, restore} {
+		require.NoError(t, pipeline(task))
+	}
+
+	assert.Equal(t, []string{newer.UUID}, observed, "each policy run is observed once, older ones and restores never")
+	_, err = views.noPolicy.store.Get(views.noPolicy.key(restore))
+	assert.NoError(t, err, "tasks without a policy are still cached")
+	for _, cfg := range []cacheConfig{views.policy, views.tenant, views.machine} {
+		got, err := cfg.store.Get(cfg.key(newer))
+		require.NoError(t, err, cfg.view)
+		assert.Equal(t, newer.UUID, got.UUID, "%s keeps the newest task", cfg.view)
+		// the same task seen again is written again, only older ones are skipped
+		assert.Equal(t, 2.0, testutil.ToFloat64(cacheWritten.WithLabelValues(cfg.view)), cfg.view)
+		assert.Equal(t, 1.0, testutil.ToFloat64(cacheSkipped.WithLabelValues(cfg.view)), cfg.view)
+	}
+	count, err := views.task.store.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count, "every task is kept by uuid")
+	history, err := views.history.Get(tgtStr(newer.Policy.ID))
+	require.NoError(t, err)
+	assert.Len(t, history.Runs, 2)
+}
+
+func TestRefreshRunning(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	api := acronisMockConn(t)
+
+	// oldest first, a policy's next run is enqueued behind the running one
+	tasks := []map[string]interface{}{
+		{"uuid": "run", "policy": map[string]string{"id": "busy"}, "state": "running", "updatedAt": "2021-01-01T00:00:00Z"},
+		{"uuid": "queued", "policy": map[string]string{"id": "busy"}, "state": "enqueued", "updatedAt": "2021-01-01T01:00:00Z"},
+		{"uuid": "waiting", "policy": map[string]string{"id": "idle"}, "state": "enqueued", "updatedAt": "2021-01-01T02:00:00Z"},
+	}
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/task_manager/v2/tasks"}).String(),
+		httpmock.NewJsonResponderOrPanic(http.StatusOK, map[string]interface{}{"items": tasks}))
+
+	cfg := cacheByPolicy("running", newMemoryStore())
+	var finished Task
+	finished.Policy.ID = "done"
+	require.NoError(t, writeTask(finished, cfg))
+
+	require.NoError(t, refreshRunning(context.Background(), &api, cfg))
+
+	busy, err := cfg.store.Get("busy")
+	require.NoError(t, err)
+	assert.Equal(t, "run", busy.UUID, "an enqueued run doesn't hide the running one")
+	idle, err := cfg.store.Get("idle")
+	require.NoError(t, err)
+	assert.Equal(t, "waiting", idle.UUID)
+	_, err = cfg.store.Get("done")
+	assert.Equal(t, errNotCached, err, "finished tasks are dropped")
+}
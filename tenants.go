@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+var tenantRefresh = kingpin.Flag("tenantRefresh",
+	"interval to recrawl the tenant hierarchy, 0 disables crawling").
+	Default("6h").Duration()
+
+var (
+	tenantCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tenant_tree", "tenants"),
+		"Count of tenants in the crawled hierarchy by kind",
+		[]string{"kind"}, nil)
+	tenantUpdatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tenant_tree", "updated_timestamp_seconds"),
+		"Time of the last completed tenant crawl",
+		nil, nil)
+)
+
+// tenantNode is a single tenant in the hierarchy
+type tenantNode struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Enabled  bool     `json:"enabled"`
+	ParentID string   `json:"parent_id"`
+	Parents  []string `json:"parents"` // uuids from the root down to the direct parent
+	Children []string `json:"children"`
+}
+
+// tenantTreeData is the on-disk form of a tenantTree
+type tenantTreeData struct {
+	Root    string                `json:"root"`
+	Updated time.Time             `json:"updated"`
+	Tenants map[string]tenantNode `json:"tenants"`
+	Legacy  map[string]string     `json:"legacy"` // v1 group id to v2 uuid, "" if unknown
+}
+
+// tenantTree is the partner -> customer -> unit hierarchy below the client's
+// tenant, kept in memory and mirrored to disk.
+type tenantTree struct {
+	mu   sync.RWMutex
+	path string
+	data tenantTreeData
+}
+
+// loadTenantTree reads a tenant tree from disk, a missing file is an empty tree
+func loadTenantTree(path string) (*tenantTree, error) {
+	tree := &tenantTree{
+		path: path,
+		data: tenantTreeData{
+			Tenants: map[string]tenantNode{},
+			Legacy:  map[string]string{},
+		},
+	}
+	f, err := lockedfile.OpenFile(path, os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return tree, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&tree.data); err != nil {
+		return nil, fmt.Errorf("problem reading tenant tree %s: %w", path, err)
+	}
+	if tree.data.Tenants == nil {
+		tree.data.Tenants = map[string]tenantNode{}
+	}
+	if tree.data.Legacy == nil {
+		tree.data.Legacy = map[string]string{}
+	}
+	return tree, nil
+}
+
+// save writes the tree to disk
+func (t *tenantTree) save() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f, err := lockedfile.OpenFile(t.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(t.data)
+}
+
+// Lookup finds a tenant by its v2 uuid
+func (t *tenantTree) Lookup(id string) (tenantNode, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	node, ok := t.data.Tenants[id]
+	return node, ok
+}
+
+// LookupTask finds the tenant a task ran under. Tasks carry the v1 group id,
+// so this relies on the legacy map, falling back to a unique name match.
+func (t *tenantTree) LookupTask(task Task) (tenantNode, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if node, ok := t.data.Tenants[t.data.Legacy[task.Tenant.ID]]; ok {
+		return node, true
+	}
+	if node, ok := t.data.Tenants[task.Tenant.ID]; ok {
+		return node, true
+	}
+
+	var found []tenantNode
+	for _, node := range t.data.Tenants {
+		if task.Tenant.Name != "" && node.Name == task.Tenant.Name {
+			found = append(found, node)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], true
+	}
+	return tenantNode{}, false
+}
+
+// Ancestors returns the parents of a tenant, starting at the root
+func (t *tenantTree) Ancestors(id string) []tenantNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ret []tenantNode
+	for _, parentID := range t.data.Tenants[id].Parents {
+		if parent, ok := t.data.Tenants[parentID]; ok {
+			ret = append(ret, parent)
+		}
+	}
+	return ret
+}
+
+// Descendants returns every tenant below a tenant
+func (t *tenantTree) Descendants(id string) []tenantNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ret []tenantNode
+	queue := t.data.Tenants[id].Children
+	for len(queue) > 0 {
+		child, ok := t.data.Tenants[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+		ret = append(ret, child)
+		queue = append(queue, child.Children...)
+	}
+	return ret
+}
+
+// lookupTarget finds the tenant of a probe target, which is a tenant name,
+// uuid or v1 id like the tenant of a task
+func (t *tenantTree) lookupTarget(target string) tenantNode {
+	var task Task
+	task.Tenant.ID, task.Tenant.Name = target, target
+	node, _ := t.LookupTask(task)
+	return node
+}
+
+// namePath is the slash separated names from the root down to the tenant,
+// starting below the nearest ancestor outside of scope
+func (t *tenantTree) namePath(node tenantNode, scope *tenantScope) string {
+	names := []string{node.Name}
+	ancestors := t.Ancestors(node.ID)
+	for i := len(ancestors) - 1; i >= 0 && scope.allowsTenant(ancestors[i].ID); i-- {
+		names = append([]string{ancestors[i].Name}, names...)
+	}
+	return strings.Join(names, "/")
+}
+
+// legacyID reports the uuid known for a v1 group id
+func (t *tenantTree) legacyID(v1ID string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	uuid, ok := t.data.Legacy[v1ID]
+	return uuid, ok
+}
+
+// v1ID finds the v1 group id of a tenant by its name, uuid or v1 id, false
+// until a task of the tenant has been mapped to its uuid
+func (t *tenantTree) v1ID(target string) (string, bool) {
+	if _, ok := t.legacyID(target); ok {
+		return target, true
+	}
+	node := t.lookupTarget(target)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for v1ID, uuid := range t.data.Legacy {
+		if uuid != "" && uuid == node.ID {
+			return v1ID, true
+		}
+	}
+	return "", false
+}
+
+func (t *tenantTree) setLegacyID(v1ID, uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data.Legacy[v1ID] = uuid
+}
+
+// replace swaps in a freshly crawled set of tenants
+func (t *tenantTree) replace(root string, tenants map[string]tenantNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data.Root = root
+	t.data.Tenants = tenants
+	t.data.Updated = time.Now()
+}
+
+func (t *tenantTree) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantCountDesc
+	ch <- tenantUpdatedDesc
+}
+
+func (t *tenantTree) Collect(ch chan<- prometheus.Metric) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	kinds := map[string]int{}
+	for _, node := range t.data.Tenants {
+		kinds[node.Kind]++
+	}
+	for kind, count := range kinds {
+		ch <- prometheus.MustNewConstMetric(tenantCountDesc,
+			prometheus.GaugeValue, float64(count), kind)
+	}
+	var updated float64
+	if !t.data.Updated.IsZero() {
+		updated = float64(t.data.Updated.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(tenantUpdatedDesc, prometheus.GaugeValue, updated)
+}
+
+// crawlTenants walks the hierarchy breadth first from the root tenant.
+// Tenants removed while crawling are skipped, any other error aborts.
+func (a *AcronisAPI) crawlTenants(ctx context.Context, root string) (map[string]tenantNode, error) {
+	tenants := map[string]tenantNode{}
+	queue := []tenantNode{{ID: root}}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		infoCtx, cancel := context.WithTimeout(ctx, a.timeout)
+		info, err := a.TenantInfo(infoCtx, node.ID)
+		cancel()
+		if apiErr, ok := asAPIError(err); ok && apiErr.NotFound() {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem getting tenant %s: %w", node.ID, err)
+		}
+		node.Name = info.Name
+		node.Kind = info.Kind
+		node.Enabled = info.Enabled
+		node.ParentID = info.ParentID
+
+		childCtx, cancel := context.WithTimeout(ctx, a.timeout)
+		children, err := a.TenantChildren(childCtx, node.ID)
+		cancel()
+		if apiErr, ok := asAPIError(err); ok && apiErr.NotFound() {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem listing children of %s: %w", node.ID, err)
+		}
+		node.Children = children
+		tenants[node.ID] = node
+
+		parents := append(append([]string{}, node.Parents...), node.ID)
+		for _, child := range children {
+			if _, seen := tenants[child]; !seen {
+				queue = append(queue, tenantNode{ID: child, Parents: parents})
+			}
+		}
+	}
+	return tenants, nil
+}
+
+// refreshTenantsFunc creates a fn to recrawl the hierarchy into the tree.
+// On failure the previous tree is kept.
+func refreshTenantsFunc(dying context.Context, api *AcronisAPI, tree *tenantTree) func() {
+	return func() {
+		start := time.Now()
+		tenants, err := api.crawlTenants(dying, api.rootTenant)
+		if err != nil {
+			log.Printf("problem crawling tenants: %v", err)
+			return
+		}
+		tree.replace(api.rootTenant, tenants)
+		if err = tree.save(); err != nil {
+			log.Printf("problem saving tenant tree: %v", err)
+		}
+		log.Printf("crawled %d tenants in %s\n", len(tenants), time.Since(start).String())
+	}
+}
+
+// legacyRetry is how long a failed legacy lookup is remembered before the
+// tenant is looked up again
+const legacyRetry = 5 * time.Minute
+
+// mapLegacyTenants resolves the v1 group id of each task to a v2 uuid, so
+// the tree can be used to look up tasks. Lookups are remembered, failures
+// for legacyRetry, and a failed lookup never stops the task from being
+// cached. Lookups stop with the walk.
+func mapLegacyTenants(api *AcronisAPI, tree *tenantTree, next taskPipelineFunc) walkPipelineFunc {
+	var mu sync.Mutex
+	failed := map[string]time.Time{} // v1 id to when to look it up again
+
+	return func(walk context.Context) taskPipelineFunc {
+		return func(t Task) error {
+			if t.Tenant.ID == "" {
+				return next(t)
+			}
+			if _, known := tree.legacyID(t.Tenant.ID); known {
+				return next(t)
+			}
+			mu.Lock()
+			retry, seen := failed[t.Tenant.ID]
+			mu.Unlock()
+			if seen && time.Now().Before(retry) {
+				return next(t)
+			}
+
+			ctx, cancel := context.WithTimeout(walk, api.timeout)
+			uuid, err := api.TenantIDToUUID(ctx, t.Tenant.ID)
+			cancel()
+			apiErr, isAPIErr := asAPIError(err)
+			switch {
+			case err == nil:
+				tree.setLegacyID(t.Tenant.ID, uuid)
+			case isAPIErr && apiErr.NotFound():
+				tree.setLegacyID(t.Tenant.ID, "")
+			case walk.Err() == nil:
+				log.Printf("problem looking up tenant %s, retrying in %s: %v",
+					t.Tenant.ID, legacyRetry.String(), err)
+				mu.Lock()
+				failed[t.Tenant.ID] = time.Now().Add(legacyRetry)
+				mu.Unlock()
+			}
+			return next(t)
+		}
+	}
+}
+
+// tenantRollupExtra labels a tenant probe with where the tenant sits in the
+// tree, going by one of the tenant's own tasks
+func tenantRollupExtra(tree *tenantTree) rollupExtraFunc {
+	extra := tenantProbeExtra(tree)
+	return func(registry *prometheus.Registry, target tgtStr, tasks []Task, scope *tenantScope) error {
+		for _, task := range tasks {
+			if tenantTarget(task) == target {
+				return extra(registry, task, scope)
+			}
+		}
+		return nil
+	}
+}
+
+// tenantProbeExtra labels a probe with where the task's tenant sits in the
+// tree, as far up as the caller's scope reaches
+func tenantProbeExtra(tree *tenantTree) probeExtraFunc {
+	return func(registry *prometheus.Registry, task Task, scope *tenantScope) error {
+		node, ok := tree.LookupTask(task)
+		if !ok {
+			return nil
+		}
+		var parentName string
+		if parent, ok := tree.Lookup(node.ParentID); ok && scope.allowsTenant(parent.ID) {
+			parentName = parent.Name
+		}
+
+		info := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "tenant_info",
+				Help:      "Position of the policy's tenant in the hierarchy",
+			}, []string{
+				"tenantUuid",
+				"tenantKind",
+				"tenantEnabled",
+				"parentName",
+				"tenantPath",
+			},
+		).WithLabelValues(
+			node.ID,
+			node.Kind,
+			fmt.Sprint(node.Enabled),
+			parentName,
+			tree.namePath(node, scope),
+		)
+		info.Set(1)
+		return registry.Register(info)
+	}
+}
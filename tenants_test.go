@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantMockTree crawls the mock hierarchy into a tree saved under a tempdir
+func tenantMockTree(t *testing.T) *tenantTree {
+	api := acronisMockConn(t)
+	httpmockRegisterTenants(t, "testdata/mock/tenants")
+	httpmock.RegisterResponder(http.MethodGet,
+		"http://dev-cloud.acronis.com/api/2/tenants/"+testTenantGone,
+		httpmock.NewStringResponder(http.StatusNotFound, `{"error":{"code":404,"message":"gone"}}`))
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "tenants")
+	require.NoError(t, err)
+	tree, err := loadTenantTree(filepath.Join(tempdir, "tenants.json"))
+	require.NoError(t, err)
+
+	refreshTenantsFunc(context.Background(), &api, tree)()
+	return tree
+}
+
+func TestCrawlTenants(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+
+	for id, td := range testCrawlTenants_testdata {
+		node, ok := tree.Lookup(id)
+		require.True(t, ok, id)
+		assert.Equal(t, td.name, node.Name)
+		assert.Equal(t, td.kind, node.Kind)
+		assert.Equal(t, td.enabled, node.Enabled)
+		assert.Equal(t, td.parents, node.Parents)
+	}
+	_, ok := tree.Lookup(testTenantGone)
+	assert.False(t, ok)
+
+	// and it survives a round trip to disk
+	loaded, err := loadTenantTree(tree.path)
+	require.NoError(t, err)
+	assert.Equal(t, tree.data.Tenants, loaded.data.Tenants)
+	assert.Equal(t, "Liquid Web/C3R2PB/Accounting",
+		loaded.namePath(loaded.data.Tenants["4f0c3b5e-8a1d-4a5e-9d3c-2a7e6f1b9c10"], nil))
+}
+
+func TestMapLegacyTenants(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	api := acronisMockConn(t)
+
+	task, err := readTask("testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json")
+	require.NoError(t, err)
+
+	var seen bool
+	pipeline := mapLegacyTenants(&api, tree, func(Task) error {
+		seen = true
+		return nil
+	})(context.Background())
+	require.NoError(t, pipeline(task))
+	assert.True(t, seen)
+
+	node, ok := tree.LookupTask(task)
+	require.True(t, ok)
+	assert.Equal(t, "1ca2ea47-e6f1-48af-9328-41757c298d03", node.ID)
+}
+
+func TestMapLegacyTenantsFailure(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	tree := tenantMockTree(t)
+	api := acronisMockConn(t)
+
+	var calls int
+	httpmock.RegisterResponder(http.MethodGet,
+		acronisTestURL.ResolveReference(&url.URL{Path: "./api/1/groups/broken"}).String(),
+		func(req *http.Request) (*http.Response, error) {
+			calls++
+			return httpmock.NewStringResponse(http.StatusServiceUnavailable, ""), nil
+		})
+
+	var task Task
+	task.Tenant.ID = "broken"
+	var seen int
+	pipeline := mapLegacyTenants(&api, tree, func(Task) error {
+		seen++
+		return nil
+	})(context.Background())
+
+	require.NoError(t, pipeline(task))
+	require.NoError(t, pipeline(task))
+	assert.Equal(t, 2, seen, "a failed lookup still passes the task on")
+	assert.Equal(t, 1, calls, "a failed lookup is remembered")
+	_, known := tree.legacyID("broken")
+	assert.False(t, known)
+}
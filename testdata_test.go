@@ -188,7 +188,7 @@ var testWriteTask_testdata = map[string]struct {
 	},
 }
 
-var testFilterTaskUpdatesOnly_testdata = map[string]struct {
+var testIngestPipelineUpdates_testdata = map[string]struct {
 	taskPath []string
 	cacheDir string
 	lastTs   time.Time
@@ -198,21 +198,21 @@ var testFilterTaskUpdatesOnly_testdata = map[string]struct {
 		taskPath: []string{
 			"testdata/mock/byTask/020c2794-e24c-4c78-af8f-f5f4f6cca110.json",
 		},
-		cacheDir: "testdata/cache/filterUpdates",
+		cacheDir: "testdata/cache/ingestUpdates",
 	},
 	"olderFirst": {
 		taskPath: []string{
 			"testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json",
 			"testdata/mock/byTask/391cf484-f9a9-4491-b379-d18cec00fa55.json",
 		},
-		cacheDir: "testdata/cache/filterUpdates",
+		cacheDir: "testdata/cache/ingestUpdates",
 	},
 	"newerFirst": {
 		taskPath: []string{
 			"testdata/mock/byTask/391cf484-f9a9-4491-b379-d18cec00fa55.json",
 			"testdata/mock/byTask/7130f8f5-192f-4017-b668-d0cad9b672a0.json",
 		},
-		cacheDir: "testdata/cache/filterUpdates",
+		cacheDir: "testdata/cache/ingestUpdates",
 	},
 	"badDest": {
 		taskPath: []string{"testdata/mock/byTask/020c2794-e24c-4c78-af8f-f5f4f6cca110.json"},
@@ -236,6 +236,7 @@ var testProbeHandler_testdata = []string{
 	"eff6f78f-584e-46e7-9b78-9da3771cf2ba",
 	"fdec0d76-e405-4cd9-b657-37a9cdf314c7",
 	"missing",
+	"a4c2e1d0-6b3f-4e8a-9c57-2d1f0b8e6a34",
 }
 
 var testTenantIDToUUID_testdata = map[string]struct {
@@ -245,3 +246,266 @@ var testTenantIDToUUID_testdata = map[string]struct {
 	"C3R2PB": {id: "1272636", uuid: "1ca2ea47-e6f1-48af-9328-41757c298d03"},
 	"RZU0ND": {id: "1272639", uuid: "e8846c9a-41db-4534-bcbb-29b21a5eb34d"},
 }
+
+var testAcronisAPI_CallRetry_testdata = map[string]struct {
+	method    string
+	statuses  []int
+	expStatus int
+	expCalls  int
+	expErr    bool
+}{
+	"recovers": {
+		method:    http.MethodGet,
+		statuses:  []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+		expStatus: http.StatusOK,
+		expCalls:  3,
+	},
+	"exhausted": {
+		method:    http.MethodGet,
+		statuses:  []int{429, 429, 429, 429},
+		expStatus: http.StatusTooManyRequests,
+		expCalls:  3,
+		expErr:    true,
+	},
+	"notIdempotent": {
+		method:    http.MethodPost,
+		statuses:  []int{http.StatusServiceUnavailable},
+		expStatus: http.StatusServiceUnavailable,
+		expCalls:  1,
+		expErr:    true,
+	},
+	"notRetryable": {
+		method:    http.MethodGet,
+		statuses:  []int{http.StatusNotFound},
+		expStatus: http.StatusNotFound,
+		expCalls:  1,
+		expErr:    true,
+	},
+}
+
+var testAPIError_testdata = map[string]struct {
+	status int
+	body   string
+	expErr APIError
+}{
+	"idp": {
+		status: http.StatusBadRequest,
+		body:   `{"error":"invalid_request","error_description":"bad grant"}`,
+		expErr: APIError{StatusCode: 400, Code: "invalid_request", Message: "bad grant"},
+	},
+	"nested": {
+		status: http.StatusNotFound,
+		body:   `{"error":{"code":404,"message":"tenant not found"}}`,
+		expErr: APIError{StatusCode: 404, Code: "404", Message: "tenant not found"},
+	},
+	"raw": {
+		status: http.StatusBadGateway,
+		body:   "upstream went away\n",
+		expErr: APIError{StatusCode: 502, Message: "upstream went away"},
+	},
+}
+
+// httpmockRegisterTenants registers a GET /api/2/tenants/{uuid} responder for
+// every [uuid].json file in dir. These can't live in the httpmock tree, as
+// the children of a tenant are at /api/2/tenants/{uuid}/children
+func httpmockRegisterTenants(t *testing.T, dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	for _, fpath := range files {
+		fileBytes, err := ioutil.ReadFile(fpath)
+		require.NoError(t, err)
+		uuid := strings.TrimSuffix(filepath.Base(fpath), ".json")
+		httpmock.RegisterResponder(http.MethodGet,
+			acronisTestURL.ResolveReference(&url.URL{Path: "/api/2/tenants/" + uuid}).String(),
+			httpmock.NewBytesResponder(http.StatusOK, fileBytes))
+	}
+}
+
+const testTenantGone = "0d5e7c1a-3b2f-4c8e-9a61-5f4b2e8d7c30"
+
+var testCrawlTenants_testdata = map[string]struct {
+	name    string
+	kind    string
+	enabled bool
+	parents []string
+}{
+	"c8e6259d-a4d7-4ffc-8614-79c1d143cc54": {name: "Liquid Web", kind: "partner", enabled: true},
+	"1ca2ea47-e6f1-48af-9328-41757c298d03": {
+		name: "C3R2PB", kind: "customer", enabled: true,
+		parents: []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"},
+	},
+	"e8846c9a-41db-4534-bcbb-29b21a5eb34d": {
+		name: "RZU0ND", kind: "customer",
+		parents: []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"},
+	},
+	"4f0c3b5e-8a1d-4a5e-9d3c-2a7e6f1b9c10": {
+		name: "Accounting", kind: "unit", enabled: true,
+		parents: []string{
+			"c8e6259d-a4d7-4ffc-8614-79c1d143cc54",
+			"1ca2ea47-e6f1-48af-9328-41757c298d03",
+		},
+	},
+}
+
+var testUsageHandler_testdata = map[string]string{
+	"customer": "1ca2ea47-e6f1-48af-9328-41757c298d03",
+	"missing":  "",
+}
+
+var testPolicyCollector_testdata = map[string]struct {
+	maxPolicies int
+	maxAge      time.Duration
+}{
+	"all":     {},
+	"limited": {maxPolicies: 1},
+	"tooOld":  {maxAge: 24 * time.Hour},
+}
+
+var testResumeCache_testdata = map[string]struct {
+	state      ingestState
+	expUpdated time.Time
+}{
+	"fresh": {
+		expUpdated: time.Date(2020, 11, 15, 18, 30, 4, 632749809, time.UTC),
+	},
+	"cursor": {
+		state: ingestState{
+			Updated:  time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC),
+			After:    "c2F2ZWQgY3Vyc29y",
+			CursorAt: time.Now(),
+		},
+		expUpdated: time.Date(2020, 11, 15, 18, 30, 4, 632749809, time.UTC),
+	},
+	"ahead": {
+		state: ingestState{
+			Updated: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		expUpdated: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+var testRunningProbeExtra_testdata = map[string]struct {
+	state    string
+	elapsed  time.Duration
+	running  float64
+	stuck    float64
+	enqueued float64
+}{
+	"idle":     {},
+	"running":  {state: "running", elapsed: time.Hour, running: 1},
+	"stuck":    {state: "running", elapsed: 30 * time.Hour, running: 1, stuck: 1},
+	"enqueued": {state: "enqueued", enqueued: 1},
+}
+
+// runs are oldest first, each a day apart and ending an hour ago
+var testHistoryProbeExtra_testdata = map[string]struct {
+	results  []string
+	failures float64
+	ratio2d  float64
+	ratio7d  float64
+	success  bool
+}{
+	"healthy":  {results: []string{"ok", "warning", "ok"}, ratio2d: 1, ratio7d: 1, success: true},
+	"flapping": {results: []string{"error", "ok", "error", "ok", "error"}, failures: 1, ratio2d: 0.5, ratio7d: 0.5, success: true},
+	"failing":  {results: []string{"ok", "ok", "ok", "error", "error"}, failures: 2, ratio2d: 0, ratio7d: 0.5, success: true},
+	"never":    {results: []string{"error", "error"}, failures: 2},
+}
+
+var testTargetKey_testdata = map[string]struct {
+	target tgtStr
+	key    string
+	expErr string
+}{
+	"uuid":      {target: "FC1E08D9-A52D-4CD6-87A1-76E754D994ED", key: "FC1E08D9-A52D-4CD6-87A1-76E754D994ED"},
+	"name":      {target: "GBEWPG", key: "GBEWPG"},
+	"traversal": {target: "../../etc/passwd", key: "%2E.%2F..%2Fetc%2Fpasswd"},
+	"slash":     {target: "Acme/Sales", key: "Acme%2FSales"},
+	"dot":       {target: ".", key: "%2E"},
+	"percent":   {target: "100% Backup", key: "100%25%20Backup"},
+	"unicode":   {target: "Café", key: "Caf%C3%A9"},
+	"empty":     {expErr: "target is empty"},
+	"control":   {target: "a\x00b", expErr: "target contains control characters"},
+	"invalid":   {target: "\xff", expErr: "target is not valid utf-8"},
+	"long":      {target: tgtStr(strings.Repeat("/", 100)), expErr: "target is longer than 250 bytes once encoded"},
+}
+
+// entries of a view, by key, with the age of their last task
+var testCacheGC_testdata = map[string]struct {
+	markStale  bool
+	ages       map[tgtStr]time.Duration
+	expKept    []string
+	expStale   []string
+	expRemoved []string
+}{
+	"remove": {
+		ages:       map[tgtStr]time.Duration{"fresh": time.Hour, "old": 100 * 24 * time.Hour, "older": 400 * 24 * time.Hour},
+		expKept:    []string{"fresh"},
+		expRemoved: []string{"old", "older"},
+	},
+	"markStale": {
+		markStale: true,
+		ages:      map[tgtStr]time.Duration{"fresh": time.Hour, "old": 100 * 24 * time.Hour},
+		expKept:   []string{"fresh", "old"},
+		expStale:  []string{"old"},
+	},
+}
+
+// the task checked is a backup policy
+var testFreshness_testdata = map[string]struct {
+	maxAge time.Duration
+	byType map[string]string
+	age    time.Duration
+	stale  bool
+}{
+	"unlimited":   {age: 90 * 24 * time.Hour},
+	"fresh":       {maxAge: 48 * time.Hour, age: time.Hour},
+	"stale":       {maxAge: 48 * time.Hour, age: 72 * time.Hour, stale: true},
+	"typeLonger":  {maxAge: 48 * time.Hour, byType: map[string]string{"backup": "168h"}, age: 72 * time.Hour},
+	"typeShorter": {byType: map[string]string{"backup": "24h"}, age: 36 * time.Hour, stale: true},
+	"otherType":   {maxAge: 48 * time.Hour, byType: map[string]string{"replication": "1h"}, age: 2 * time.Hour},
+}
+
+var testEndpointLabel_testdata = map[string]string{
+	"/api/2/tenants/1ca2ea47-e6f1-48af-9328-41757c298d03/children": "/api/2/tenants/{id}/children",
+	"/api/2/tenants/usages":      "/api/2/tenants/usages",
+	"/api/1/groups/1272636":      "/api/1/groups/{id}",
+	"/api/task_manager/v2/tasks": "/api/task_manager/v2/tasks",
+}
+
+var testTenantScope_testdata = map[string]struct {
+	tenants  []string
+	subtrees []string
+	allowed  []string // policy ids of testdata/mock/byPolicy
+}{
+	"partner subtree": {
+		subtrees: []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"},
+		allowed:  []string{"67DC1F51-DEF3-4654-BA09-454DABFEAC69", "FC1E08D9-A52D-4CD6-87A1-76E754D994ED"},
+	},
+	"customer uuid": {
+		tenants: []string{"1ca2ea47-e6f1-48af-9328-41757c298d03"},
+		allowed: []string{"67DC1F51-DEF3-4654-BA09-454DABFEAC69"},
+	},
+	"customer v1 id": {
+		tenants: []string{"1272639"},
+		allowed: []string{"FC1E08D9-A52D-4CD6-87A1-76E754D994ED"},
+	},
+	"partner only": {
+		tenants: []string{"c8e6259d-a4d7-4ffc-8614-79c1d143cc54"},
+	},
+	"unit subtree": {
+		subtrees: []string{"4f0c3b5e-8a1d-4a5e-9d3c-2a7e6f1b9c10"},
+	},
+}
+
+var testMachineProbe_testdata = map[string]string{
+	"fileserver": "cloudvmfileserver.support.lwtraining.net",
+	"lb":         "cloudvmlb.support.lwtraining.net",
+	"missing":    "nope.example.com",
+}
+
+var testTenantProbe_testdata = map[string]url.Values{
+	"customer":         {"target": {"C3R2PB"}},
+	"customerChildren": {"target": {"C3R2PB"}, "children": {"true"}},
+	"partnerChildren":  {"target": {"Liquid Web"}, "children": {"true"}},
+	"missing":          {"target": {"GBEWPG"}},
+}
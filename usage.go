@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var usageLabels = []string{
+	"tenantId",
+	"tenantName",
+	"usage",
+	"edition",
+	"unit",
+}
+
+// scrapeTimeoutOffset is left of the scrape timeout Prometheus sends, to
+// answer before it gives up
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// scrapeTimeout is how long a probe may take, from the timeout Prometheus
+// sends with each scrape and never above max
+func scrapeTimeout(r *http.Request, max time.Duration) time.Duration {
+	secs, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || secs <= 0 {
+		return max
+	}
+	timeout := time.Duration(secs * float64(time.Second))
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	if timeout > max {
+		return max
+	}
+	return timeout
+}
+
+// usageHandler probes the storage usage and quotas of a tenant uuid.
+// Unlike the policy probes, this goes to the API on every scrape, once and
+// within the scrape timeout, as a retry would land after Prometheus gave up.
+func usageHandler(api *AcronisAPI, tree *tenantTree) http.Handler {
+	noRetry := *api
+	noRetry.retry = retryPolicy{}
+	api = &noRetry
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		registry := prometheus.NewRegistry()
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Boolean if probe was successful",
+		})
+		probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "milliseconds for probe to respond",
+		})
+		for _, c := range []prometheus.Collector{probeSuccess, probeDurationGauge} {
+			if err := registry.Register(c); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target is required", http.StatusBadRequest)
+			return
+		}
+		if !scopeFrom(r.Context()).allowsTenant(target) {
+			http.Error(w, "target outside of token scope", http.StatusForbidden)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, api.timeout))
+		usages, err := api.TenantUsages(ctx, target)
+		cancel()
+		if err != nil {
+			log.Printf("problem getting usages of %s: %v", target, err)
+			probeSuccess.Set(0)
+		} else {
+			probeSuccess.Set(1)
+			var tenantName string
+			if node, ok := tree.Lookup(target); ok {
+				tenantName = node.Name
+			}
+			if err = usagesToRegistry(registry, target, tenantName, usages); err != nil {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		probeDurationGauge.Set(float64(time.Since(start).Milliseconds()))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// usagesToRegistry adds usage, quota and percent of quota for each usage.
+// Usages sharing the same labels, such as one per infra, are summed.
+func usagesToRegistry(
+	registry *prometheus.Registry,
+	tenantID, tenantName string,
+	usages []TenantUsage,
+) error {
+	usageVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tenant_usage",
+		Help:      "Current usage of an offering item",
+	}, usageLabels)
+	quotaVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tenant_quota",
+		Help:      "Quota of an offering item, absent if unlimited",
+	}, usageLabels)
+	overageVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tenant_quota_overage",
+		Help:      "Allowed overage above the quota of an offering item",
+	}, usageLabels)
+	percentVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tenant_usage_quota_percent",
+		Help:      "Usage as a percentage of quota, absent if unlimited",
+	}, usageLabels)
+
+	type total struct {
+		labels       []string
+		value, quota float64
+	}
+	totals := map[string]*total{}
+
+	for _, usage := range usages {
+		labels := []string{tenantID, tenantName, usage.Name, usage.Edition, usage.MeasurementUnit}
+		usageVec.WithLabelValues(labels...).Add(usage.Value)
+
+		quota := usage.OfferingItem.Quota
+		if quota == nil || quota.Value == nil {
+			continue
+		}
+		quotaVec.WithLabelValues(labels...).Add(*quota.Value)
+		if quota.Overage != nil {
+			overageVec.WithLabelValues(labels...).Add(*quota.Overage)
+		}
+
+		key := usage.Name + "\x00" + usage.Edition + "\x00" + usage.MeasurementUnit
+		if _, ok := totals[key]; !ok {
+			totals[key] = &total{labels: labels}
+		}
+		totals[key].value += usage.Value
+		totals[key].quota += *quota.Value
+	}
+
+	for _, t := range totals {
+		if t.quota > 0 {
+			percentVec.WithLabelValues(t.labels...).Set(t.value / t.quota * 100)
+		}
+	}
+
+	for _, c := range []prometheus.Collector{usageVec, quotaVec, overageVec, percentVec} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+var (
+	initialBackfill = kingpin.Flag("initialBackfill",
+		"history to load when there is no saved ingest state").
+		Default("48h").Duration()
+	maxCatchup = kingpin.Flag("maxCatchup",
+		"maximum history to catch up on after an outage").
+		Default("720h").Duration()
+	cursorTTL = kingpin.Flag("cursorTTL",
+		"maximum age of a saved paging cursor to resume from").
+		Default("1h").Duration()
+)
+
+// watermarkOverlap is re-read on every poll to catch tasks sharing a timestamp
+const watermarkOverlap = time.Minute
+
+// ingestState is what has been processed so far, saved between runs
+type ingestState struct {
+	Updated  time.Time `json:"updatedAt"`          // newest task processed
+	After    string    `json:"after,omitempty"`    // cursor of an unfinished walk
+	CursorAt time.Time `json:"cursorAt,omitempty"` // when After was saved
+}
+
+// watermark tracks the newest task processed, so polls continue where the
+// last one stopped rather than re-reading a fixed window.
+type watermark struct {
+	mu    sync.Mutex
+	path  string
+	state ingestState
+}
+
+// loadWatermark reads the saved state, a missing file starts from nothing.
+// An empty path keeps the state in memory only.
+func loadWatermark(path string) (*watermark, error) {
+	mark := &watermark{path: path}
+	if path == "" {
+		return mark, nil
+	}
+	f, err := lockedfile.OpenFile(path, os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return mark, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mark, json.NewDecoder(f).Decode(&mark.state)
+}
+
+func (m *watermark) save() error {
+	if m.path == "" {
+		return nil
+	}
+	f, err := lockedfile.OpenFile(m.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(m.state)
+}
+
+// Updated is the newest task processed
+func (m *watermark) Updated() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.Updated
+}
+
+// checkpoint raises the watermark to the newest task of a page that was
+// processed without errors, and saves it along with the cursor of the next
+// page. Workers finish tasks out of order, so the watermark only moves once
+// a whole page is done, or a failed task could end up below it.
+func (m *watermark) checkpoint(after string, tasks []Task) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range tasks {
+		if t.Updated.After(m.state.Updated) {
+			m.state.Updated = t.Updated
+		}
+	}
+	m.state.After = after
+	m.state.CursorAt = time.Now()
+	if after == "" {
+		m.state.CursorAt = time.Time{}
+	}
+	return m.save()
+}
+
+// resumeCursor is the saved cursor if it's recent enough to still be valid
+func (m *watermark) resumeCursor(ttl time.Duration) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state.After == "" || time.Since(m.state.CursorAt) > ttl {
+		return ""
+	}
+	return m.state.After
+}
+
+// since is where the next poll starts. Without saved state it's the initial
+// backfill, and a gap longer than maxCatchup is cut short.
+func (m *watermark) since(initial, catchup time.Duration) time.Time {
+	updated := m.Updated()
+	now := time.Now()
+	if updated.IsZero() {
+		return now.Add(-initial)
+	}
+	if now.Sub(updated) > catchup {
+		log.Printf("ingest gap of %s is over the max catchup, only loading %s\n",
+			now.Sub(updated).Round(time.Second).String(), catchup.String())
+		return now.Add(-catchup)
+	}
+	return updated.Add(-watermarkOverlap)
+}
+
+// resumeCache continues ingesting from the saved cursor or watermark. The
+// watermark and cursor are saved after every page, so a restart picks up
+// where this left off.
+func resumeCache(ctx context.Context, api *AcronisAPI, cache taskPipelineFunc, mark *watermark) error {
+	if after := mark.resumeCursor(*cursorTTL); after != "" {
+		log.Printf("resuming task walk from saved cursor\n")
+		err := api.walkTasksConcurrently(ctx, url.Values{"after": []string{after}}, 5000,
+			*taskWorkers, cache, mark.checkpoint)
+		if apiErr, ok := asAPIError(err); !ok || apiErr.Temporary() || apiErr.Unauthorized() {
+			return err
+		}
+		// the cursor was rejected, likely expired, start over from the watermark
+		log.Printf("saved cursor rejected, resuming from watermark: %v", err)
+	}
+
+	since := mark.since(*initialBackfill, *maxCatchup)
+	log.Printf("loading tasks updated since %s\n", since.Format(time.RFC3339))
+	query := url.Values{}
+	query.Set("order", "asc(updatedAt)")
+	query.Set("updatedAt", "gt("+since.Format(time.RFC3339)+")")
+	query.Set("state", "completed")
+	return api.walkTasksConcurrently(ctx, query, 5000, *taskWorkers, cache, mark.checkpoint)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var webConfigFile = kingpin.Flag("webConfig",
+	"path to a web config file with TLS and users, plain HTTP without auth when empty").
+	String()
+
+// webConfig is the web config file, in the layout of the Prometheus one
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  client_ca_file: ca.crt
+//	basic_auth_users:
+//	  alice: <bcrypt hash>
+//	bearer_tokens:
+//	  - name: prometheus
+//	    token_hash: <bcrypt hash>
+//	  - name: reseller
+//	    token_hash: <bcrypt hash>
+//	    subtrees: [<tenant uuid>] # only sees these tenants and those below
+type webConfig struct {
+	TLS struct {
+		CertFile   string `yaml:"cert_file"`
+		KeyFile    string `yaml:"key_file"`
+		ClientAuth string `yaml:"client_auth_type"`
+		ClientCAs  string `yaml:"client_ca_file"`
+	} `yaml:"tls_server_config"`
+	Users  map[string]string `yaml:"basic_auth_users"`
+	Tokens []webToken        `yaml:"bearer_tokens"`
+}
+
+// webToken is a bearer token, scoped to some tenants if it lists any
+type webToken struct {
+	Name     string   `yaml:"name"`
+	Hash     string   `yaml:"token_hash"`
+	Tenants  []string `yaml:"tenants"`  // by uuid or v1 id
+	Subtrees []string `yaml:"subtrees"` // by uuid, with every tenant below
+}
+
+// scoped reports if the token is limited to some tenants
+func (t webToken) scoped() bool {
+	return len(t.Tenants) > 0 || len(t.Subtrees) > 0
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// unknownUserHash is compared against for users that don't exist, so they
+// take as long to reject as a wrong password and can't be told apart
+const unknownUserHash = "$2a$10$Kh/Bxy0FbeuL0FkXzd6GYuZci8kH9fGkSLh8bVgErgKXjVwhqpJ0."
+
+// maxRejected bounds the credentials remembered as wrong, the set starts over
+// once it is full
+const maxRejected = 1024
+
+// webServer holds the loaded web config, reloading it and the files it
+// points to whenever any of them change
+type webServer struct {
+	path string
+
+	mu       sync.Mutex
+	cfg      webConfig
+	tls      *tls.Config                    // nil without TLS
+	mtimes   map[string]time.Time           // of the files of the last load, good or not
+	loads    int                            // successful loads, so checks against an older config aren't kept
+	verified map[[sha256.Size]byte]webToken // credentials already checked, to who
+	rejected map[[sha256.Size]byte]bool     // credentials already found wrong
+}
+
+func loadWebConfig(path string) (*webServer, error) {
+	ret := &webServer{path: path}
+	if err := ret.reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// files are the files a config depends on besides itself
+func (cfg webConfig) files() []string {
+	var ret []string
+	for _, path := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAs} {
+		if path != "" {
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
+
+// modTime is when a file was last modified, zero if it can't be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// changed reports if any file was modified since the last load
+func (s *webServer) changed() bool {
+	if s.mtimes == nil {
+		return true
+	}
+	for path, mtime := range s.mtimes {
+		if !modTime(path).Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads the config again if it or any file it names changed. On
+// error the last good config stays in use, and a broken config is only read
+// again once one of the files changes.
+func (s *webServer) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changed() {
+		return nil
+	}
+
+	// files are checked before they are read, so a change while reading is
+	// picked up next time
+	mtimes := map[string]time.Time{s.path: modTime(s.path)}
+	cfg, tlsCfg, err := s.load(mtimes)
+	if err != nil {
+		// keep watching the files of the last good config too
+		for path, mtime := range s.mtimes {
+			if _, ok := mtimes[path]; !ok {
+				mtimes[path] = mtime
+			}
+		}
+		s.mtimes = mtimes
+		return err
+	}
+
+	s.cfg, s.tls, s.mtimes = cfg, tlsCfg, mtimes
+	s.loads++
+	s.verified = map[[sha256.Size]byte]webToken{}
+	s.rejected = map[[sha256.Size]byte]bool{}
+	return nil
+}
+
+// load reads the config and the files it names, adding each file to mtimes
+func (s *webServer) load(mtimes map[string]time.Time) (webConfig, *tls.Config, error) {
+	var cfg webConfig
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("problem reading web config: %w", err)
+	}
+	if err = yaml.UnmarshalStrict(raw, &cfg); err != nil {
+		return cfg, nil, fmt.Errorf("problem parsing web config: %w", err)
+	}
+	for _, path := range cfg.files() {
+		mtimes[path] = modTime(path)
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	return cfg, tlsCfg, err
+}
+
+// tlsConfig loads the certificates of the config, nil if it has none
+func (cfg webConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.TLS.CertFile == "" && cfg.TLS.KeyFile == "" {
+		if cfg.TLS.ClientAuth != "" || cfg.TLS.ClientCAs != "" {
+			return nil, fmt.Errorf("problem with web config: client certificates need a cert_file and key_file")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("problem loading server certificate: %w", err)
+	}
+	clientAuth, ok := clientAuthTypes[cfg.TLS.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("problem with web config: unknown client_auth_type %q", cfg.TLS.ClientAuth)
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.TLS.ClientCAs != "" {
+		raw, err := ioutil.ReadFile(cfg.TLS.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("problem loading client CAs: %w", err)
+		}
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("problem loading client CAs: no certificates in %s", cfg.TLS.ClientCAs)
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("problem with web config: %s needs a client_ca_file", cfg.TLS.ClientAuth)
+	}
+	return ret, nil
+}
+
+// tlsEnabled reports if the server should serve TLS
+func (s *webServer) tlsEnabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tls != nil
+}
+
+// serverTLS picks up changed certificates on each handshake
+func (s *webServer) serverTLS() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if err := s.reload(); err != nil {
+				log.Printf("problem reloading web config, keeping the last one: %v", err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.tls == nil {
+				return nil, fmt.Errorf("problem with web config: TLS was removed, restart to serve plain HTTP")
+			}
+			return s.tls, nil
+		},
+	}
+}
+
+// authenticate checks the basic auth or bearer token of a request, returning
+// who it is, users being unscoped tokens. Requests pass when the config has
+// no users or tokens.
+func (s *webServer) authenticate(r *http.Request) (webToken, bool) {
+	if err := s.reload(); err != nil {
+		log.Printf("problem reloading web config, keeping the last one: %v", err)
+	}
+
+	// bcrypt is slow on purpose, so remember credentials once checked, and
+	// check them without holding the lock
+	header := r.Header.Get("Authorization")
+	sum := sha256.Sum256([]byte(header))
+	s.mu.Lock()
+	cfg, loads := s.cfg, s.loads
+	who, verified := s.verified[sum]
+	rejected := s.rejected[sum]
+	s.mu.Unlock()
+	switch {
+	case len(cfg.Users) == 0 && len(cfg.Tokens) == 0:
+		return webToken{}, true
+	case verified:
+		return who, true
+	case rejected:
+		return webToken{}, false
+	}
+
+	ok := false
+	if user, pass, basic := r.BasicAuth(); basic {
+		hash, found := cfg.Users[user]
+		if !found {
+			hash = unknownUserHash
+		}
+		matched := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+		who, ok = webToken{Name: user}, found && matched
+	} else if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, t := range cfg.Tokens {
+			if bcrypt.CompareHashAndPassword([]byte(t.Hash), token) == nil {
+				who, ok = t, true
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loads != loads {
+		return who, ok
+	}
+	if ok {
+		s.verified[sum] = who
+	} else {
+		if len(s.rejected) >= maxRejected {
+			s.rejected = map[[sha256.Size]byte]bool{}
+		}
+		s.rejected[sum] = true
+	}
+	return who, ok
+}
+
+type anonymousKey struct{}
+
+// anonymous reports if a request reached an open path without credentials
+// that would get it past auth, or with a scoped token, so it is only told
+// what the orchestrator needs
+func anonymous(ctx context.Context) bool {
+	ret, _ := ctx.Value(anonymousKey{}).(bool)
+	return ret
+}
+
+// handler requires auth on every request, except for paths under the open
+// prefixes, such as health endpoints probed by the orchestrator. Requests of
+// scoped tokens carry their tenant scope.
+func (s *webServer) handler(next http.Handler, tree *tenantTree, open ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range open {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				if who, ok := s.authenticate(r); !ok || who.scoped() {
+					r = r.WithContext(context.WithValue(r.Context(), anonymousKey{}, true))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		who, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="acronis-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if who.scoped() {
+			r = r.WithContext(withScope(r.Context(), newTenantScope(tree, who.Tenants, who.Subtrees)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}